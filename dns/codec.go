@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"encoding/base32"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+**  NAME CODECS:  HOW UPSTREAM BYTES ARE SPELLED IN QUERY NAME LABELS
+**
+**  Some resolvers randomize the case of query names (DNS 0x20), so every text codec
+**  decodes without regard to case. The binary codec is densest, but only works where
+**  the whole path preserves 8-bit labels, so clients probe for it at session start.
+ */
+
+// NameCodec - turns upstream bytes into the octets of query name labels, and back
+type NameCodec interface {
+	// Name - the name of this codec, like "base32"
+	Name() string
+	// ID - identifies this codec in the header label of a query name
+	ID() byte
+	// EncodedLen - the most label octets needed to carry n bytes
+	EncodedLen(n int) int
+	// Encode - spells data as label octets, before it is split into labels
+	Encode(data []byte) []byte
+	// Decode - recovers data from label octets, in any case
+	Decode(b []byte) ([]byte, error)
+}
+
+// codecs for the NameCodecs registry
+var (
+	base32Codec    = textCodec{name: "base32", id: 'b', enc: base32.StdEncoding.WithPadding(base32.NoPadding)}
+	base32hexCodec = textCodec{name: "base32hex", id: 'h', enc: base32.HexEncoding.WithPadding(base32.NoPadding)}
+	base36Codec    = base36{}
+	binaryCodec    = binary8{}
+)
+
+// NameCodecs - all known name codecs, by name
+var NameCodecs = map[string]NameCodec{
+	base32Codec.Name():    base32Codec,
+	base32hexCodec.Name(): base32hexCodec,
+	base36Codec.Name():    base36Codec,
+	binaryCodec.Name():    binaryCodec,
+}
+
+// NameCodecByName - looks up a name codec by name, like "base36"
+func NameCodecByName(name string) (NameCodec, error) {
+	codec, ok := NameCodecs[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New("unknown name codec: " + name)
+	}
+	return codec, nil
+}
+
+// nameCodecByID - looks up a name codec by the ID in a header label
+func nameCodecByID(id byte) (NameCodec, bool) {
+	for _, codec := range NameCodecs {
+		if codec.ID() == id {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+//
+//  base32 / base32hex - 5 bits per octet
+//
+
+type textCodec struct {
+	name string
+	id   byte
+	enc  *base32.Encoding
+}
+
+func (c textCodec) Name() string              { return c.name }
+func (c textCodec) ID() byte                  { return c.id }
+func (c textCodec) EncodedLen(n int) int      { return c.enc.EncodedLen(n) }
+func (c textCodec) Encode(data []byte) []byte { return []byte(c.enc.EncodeToString(data)) }
+
+func (c textCodec) Decode(b []byte) ([]byte, error) {
+	return c.enc.DecodeString(strings.ToUpper(string(b)))
+}
+
+//
+//  base36 - about 5.17 bits per octet, the most a case-insensitive alphabet of letters and digits can carry
+//
+//  The data is read as one big number, behind a 0x01 byte so leading zeros survive.
+//
+
+type base36 struct{}
+
+func (base36) Name() string { return "base36" }
+func (base36) ID() byte     { return 'z' }
+
+func (base36) EncodedLen(n int) int {
+	return int(math.Ceil(float64(8*n+1) / math.Log2(36)))
+}
+
+func (base36) Encode(data []byte) []byte {
+	v := new(big.Int).SetBytes(append([]byte{1}, data...))
+	return []byte(v.Text(36))
+}
+
+func (base36) Decode(b []byte) ([]byte, error) {
+	v, ok := new(big.Int).SetString(strings.ToLower(string(b)), 36)
+	if !ok {
+		return nil, errors.New("illegal base36 data")
+	}
+	data := v.Bytes()
+	if len(data) == 0 || data[0] != 1 {
+		return nil, errors.New("illegal base36 data")
+	}
+	return data[1:], nil
+}
+
+//
+//  binary - 8 bits per octet, labels are raw bytes
+//
+
+type binary8 struct{}
+
+func (binary8) Name() string                    { return "binary" }
+func (binary8) ID() byte                        { return 'r' }
+func (binary8) EncodedLen(n int) int            { return n }
+func (binary8) Encode(data []byte) []byte       { return data }
+func (binary8) Decode(b []byte) ([]byte, error) { return b, nil }
+
+//
+//  presentation format, for label octets that aren't letters, digits or hyphens
+//
+
+// escapeLabel - writes label octets in presentation format
+func escapeLabel(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			s.WriteByte(c)
+			continue
+		}
+		s.WriteByte('\\')
+		d := strconv.Itoa(int(c))
+		s.WriteString(strings.Repeat("0", 3-len(d)) + d)
+	}
+	return s.String()
+}
+
+// unescapeLabel - reads label octets from presentation format, as \DDD or \X escapes
+func unescapeLabel(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			d, _ := strconv.Atoi(s[i+1 : i+4])
+			if d > 255 {
+				return nil, errors.New("illegal escape in label: " + s)
+			}
+			b = append(b, byte(d))
+			i += 3
+		} else if i+1 < len(s) {
+			b = append(b, s[i+1])
+			i++
+		} else {
+			return nil, errors.New("illegal escape in label: " + s)
+		}
+	}
+	return b, nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
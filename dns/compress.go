@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+/*
+**  COMPRESSION:  DEFLATING RPC FRAMES BEFORE THEY GO INTO KCP
+**
+**  Every byte through the tunnel costs query name or answer space, and serialized RPCs compress
+**  well. With Compress set, the client asks for compression in a probe at session start, again if
+**  the answer is lost, and once the server agrees, which it only does with Compress set too, the
+**  payload of every RPC frame either way starts with a flag:
+**
+**     <compressNone><serialized payload> | <compressDeflate><deflated serialized payload>
+**
+**  Payloads under minCompressSize, and any that don't come out smaller, go as they are. Each end
+**  counts the bytes going into the compressor and coming out, for the ratio in Stats.
+ */
+
+// flags at the start of a frame payload in a session that compresses
+const (
+	compressNone    = 0
+	compressDeflate = 1
+)
+
+// minCompressSize - payloads shorter than this aren't worth trying to compress
+const minCompressSize = 128
+
+var errCompression = errors.New("dns rpc frame compression unknown or corrupt")
+
+// compressPayload - the payload as it goes in a frame of a session that compresses, counted in c
+func (m *Module) compressPayload(c *counters, payload []byte) []byte {
+	out := []byte{compressNone}
+	if len(payload) >= minCompressSize {
+		var b bytes.Buffer
+		b.WriteByte(compressDeflate)
+		w, _ := flate.NewWriter(&b, flate.BestCompression) // only fails on a bad level
+		w.Write(payload)
+		if w.Close() == nil && b.Len() < 1+len(payload) {
+			out = b.Bytes()
+		}
+	}
+	if len(out) == 1 {
+		out = append(out, payload...)
+	}
+	m.count(c, statCompressIn, len(payload))
+	m.count(c, statCompressOut, len(out))
+	return out
+}
+
+// decompressPayload - the payload of a frame from a session that compresses, never more than maxFrameSize
+func decompressPayload(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errCompression
+	}
+	switch b[0] {
+	case compressNone:
+		return b[1:], nil
+	case compressDeflate:
+		r := flate.NewReader(bytes.NewReader(b[1:]))
+		defer r.Close()
+		payload, err := ioutil.ReadAll(io.LimitReader(r, maxFrameSize+1))
+		if err != nil || len(payload) > maxFrameSize {
+			return nil, errCompression
+		}
+		return payload, nil
+	}
+	return nil, errCompression
+}
@@ -0,0 +1,439 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	mdns "github.com/miekg/dns"
+
+	"github.com/awgh/ratnet/api"
+)
+
+/*
+**  CONFIG:  READING A MODULE BACK FROM THE MAP ITS MarshalJSON WROTE
+**
+**  Values decoded from JSON arrive as string, float64, bool or []interface{}, durations are
+**  strings like "20ms", and PEM certificates and keys are strings. A value of the wrong type
+**  or out of range is reported by key, and the default is kept in its place.
+**
+**  The map carries secrets as they are: the SessionKey with its private part, the TSIGSecret and
+**  the DoT Key. Whatever stores it has to keep it as safe as the node's own keys.
+ */
+
+// NewFromConfig : like NewFromMap, but returns an error describing every value in t that couldn't be used
+func NewFromConfig(node api.Node, t map[string]interface{}) (*Module, error) {
+	instance := New(node, 0xFFFFFFFF, 0xFFFFFFFF)
+	if err := instance.configure(t); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// configure - sets the exported fields from a map of arguments, skipping and reporting any that are bad
+func (m *Module) configure(t map[string]interface{}) error {
+	c := &configReader{t: t}
+
+	c.str("ListenStr", &m.ListenStr)
+	c.str("UpstreamStr", &m.UpstreamStr)
+	c.uint32("ClientConv", &m.ClientConv)
+	c.uint32("ServerConv", &m.ServerConv)
+	c.check("RecordType", &m.RecordType, func(s string) error {
+		_, err := RecordEncoderByName(s)
+		return err
+	})
+	c.check("Domain", &m.Domain, func(s string) error {
+		if _, ok := mdns.IsDomainName(s); s != "" && !ok {
+			return errors.New("not a domain name")
+		}
+		return nil
+	})
+	c.duration("RPCTimeout", &m.RPCTimeout, 0)
+	c.uint16("EDNSSize", &m.EDNSSize, func(n uint16) error {
+		if n != 0 && n < mdns.MinMsgSize {
+			return fmt.Errorf("must be 0 or at least %d", mdns.MinMsgSize)
+		}
+		return nil
+	})
+	c.check("DoHMethod", &m.DoHMethod, func(s string) error {
+		if s = strings.ToUpper(s); s != http.MethodPost && s != http.MethodGet {
+			return errors.New("must be POST or GET")
+		}
+		return nil
+	})
+	c.str("TLSListenStr", &m.TLSListenStr)
+	c.pem("Cert", &m.Cert)
+	c.pem("Key", &m.Key)
+	c.strs("TLSPins", &m.TLSPins, func(pin string) error {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return errors.New("not a CertPin: " + pin)
+		}
+		return nil
+	})
+	c.strs("Alphabets", &m.Alphabets, func(name string) error {
+		_, err := NameCodecByName(name)
+		return err
+	})
+	c.bool("ProbeMTU", &m.ProbeMTU)
+	c.duration("PollInterval", &m.PollInterval, time.Millisecond)
+	c.duration("PollMaxInterval", &m.PollMaxInterval, time.Millisecond)
+	c.float("PollJitter", &m.PollJitter, 0, 1)
+	c.float("MaxQPS", &m.MaxQPS, 0, math.MaxFloat64)
+	c.duration("StatsInterval", &m.StatsInterval, 0)
+	c.bool("Encrypt", &m.Encrypt)
+	c.check("ServerKey", &m.ServerKey, func(s string) error {
+		if s != "" {
+			return new(ecc.PubKey).FromB64(s)
+		}
+		return nil
+	})
+	c.check("TSIGKeyName", &m.TSIGKeyName, func(s string) error {
+		if _, ok := mdns.IsDomainName(s); !ok {
+			return errors.New("not a domain name")
+		}
+		return nil
+	})
+	c.check("TSIGSecret", &m.TSIGSecret, func(s string) error {
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return errors.New("not base64")
+		}
+		return nil
+	})
+	c.int("DataShards", &m.DataShards, 1, 255)
+	c.int("ParityShards", &m.ParityShards, 0, 255)
+	c.bool("Compress", &m.Compress)
+	c.float("SourceQPS", &m.SourceQPS, 0, math.MaxFloat64)
+	c.int("MaxSources", &m.MaxSources, 0, math.MaxInt32)
+	c.float("SessionQPS", &m.SessionQPS, 0, math.MaxFloat64)
+	c.int("MaxHeldQueries", &m.MaxHeldQueries, 0, math.MaxInt32)
+	c.int("MaxQuerySize", &m.MaxQuerySize, 0, mdns.MaxMsgSize)
+	c.check("LimitAction", &m.LimitAction, func(s string) error {
+		if s != LimitRefuse && s != LimitDrop {
+			return errors.New("must be " + LimitRefuse + " or " + LimitDrop)
+		}
+		return nil
+	})
+	c.strs("Resolvers", &m.Resolvers, func(addr string) error {
+		if addr == "" {
+			return errors.New("empty resolver address")
+		}
+		return nil
+	})
+	c.check("ResolverPolicy", &m.ResolverPolicy, func(s string) error {
+		if s != PolicyRoundRobin && s != PolicyWeighted {
+			return errors.New("must be " + PolicyRoundRobin + " or " + PolicyWeighted)
+		}
+		return nil
+	})
+	c.int("ResolverFailures", &m.ResolverFailures, 1, math.MaxInt32)
+	c.duration("ResolverRetry", &m.ResolverRetry, time.Millisecond)
+	c.duration("HoldTimeout", &m.HoldTimeout, 0)
+	c.int("Polls", &m.Polls, 1, 64)
+	c.int("MaxInFlight", &m.MaxInFlight, 0, 1024)
+	var sessionKey string
+	c.check("SessionKey", &sessionKey, func(s string) error {
+		if s != "" {
+			kp := new(ecc.KeyPair)
+			if err := kp.FromB64(s); err != nil {
+				return err
+			}
+			m.SessionKey = kp
+		}
+		return nil
+	})
+
+	if len(m.Cert) > 0 || len(m.Key) > 0 {
+		if _, err := tls.X509KeyPair(m.Cert, m.Key); err != nil {
+			c.errs = append(c.errs, "Cert and Key: "+err.Error())
+			m.Cert, m.Key = nil, nil
+		}
+	}
+	if m.PollMaxInterval < m.PollInterval {
+		c.errs = append(c.errs, "PollMaxInterval: must not be less than PollInterval")
+		m.PollInterval, m.PollMaxInterval = defaultPollInterval, defaultPollMaxInterval
+	}
+
+	if len(c.errs) > 0 {
+		return errors.New("dns config: " + strings.Join(c.errs, "; "))
+	}
+	return nil
+}
+
+// configMap - the config of this module, as MarshalJSON writes it and configure reads it
+func (m *Module) configMap() map[string]interface{} {
+	return map[string]interface{}{
+		"Transport":        "dns",
+		"ListenStr":        m.ListenStr,
+		"UpstreamStr":      m.UpstreamStr,
+		"ClientConv":       m.ClientConv,
+		"ServerConv":       m.ServerConv,
+		"RecordType":       m.RecordType,
+		"Domain":           m.Domain,
+		"RPCTimeout":       m.RPCTimeout.String(),
+		"EDNSSize":         m.EDNSSize,
+		"DoHMethod":        m.DoHMethod,
+		"TLSListenStr":     m.TLSListenStr,
+		"Cert":             string(m.Cert),
+		"Key":              string(m.Key),
+		"TLSPins":          nonNil(m.TLSPins),
+		"Alphabets":        nonNil(m.Alphabets),
+		"ProbeMTU":         m.ProbeMTU,
+		"PollInterval":     m.PollInterval.String(),
+		"PollMaxInterval":  m.PollMaxInterval.String(),
+		"PollJitter":       m.PollJitter,
+		"MaxQPS":           m.MaxQPS,
+		"StatsInterval":    m.StatsInterval.String(),
+		"Encrypt":          m.Encrypt,
+		"ServerKey":        m.ServerKey,
+		"SessionKey":       m.sessionKeyB64(),
+		"TSIGKeyName":      m.TSIGKeyName,
+		"TSIGSecret":       m.TSIGSecret,
+		"DataShards":       m.DataShards,
+		"ParityShards":     m.ParityShards,
+		"Compress":         m.Compress,
+		"SourceQPS":        m.SourceQPS,
+		"MaxSources":       m.MaxSources,
+		"SessionQPS":       m.SessionQPS,
+		"MaxHeldQueries":   m.MaxHeldQueries,
+		"MaxQuerySize":     m.MaxQuerySize,
+		"LimitAction":      m.LimitAction,
+		"Resolvers":        nonNil(m.Resolvers),
+		"ResolverPolicy":   m.ResolverPolicy,
+		"ResolverFailures": m.ResolverFailures,
+		"ResolverRetry":    m.ResolverRetry.String(),
+		"HoldTimeout":      m.HoldTimeout.String(),
+		"Polls":            m.Polls,
+		"MaxInFlight":      m.MaxInFlight,
+	}
+}
+
+// sessionKeyB64 - the serialized SessionKey, private part and all, or empty if it was set to nil
+func (m *Module) sessionKeyB64() string {
+	m.keyMutex.Lock()
+	defer m.keyMutex.Unlock()
+	if m.SessionKey == nil {
+		return ""
+	}
+	return m.SessionKey.ToB64()
+}
+
+// nonNil - an empty list instead of nil, so it is written as [] rather than null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// configReader - reads typed values from a config map, collecting an error for each bad one
+// Values are only stored when they are good, so a bad one leaves the default in place
+type configReader struct {
+	t    map[string]interface{}
+	errs []string
+}
+
+func (c *configReader) fail(key string, v interface{}, want string) {
+	c.errs = append(c.errs, fmt.Sprintf("%s: %s, got %T %v", key, want, v, v))
+}
+
+func (c *configReader) str(key string, dst *string) {
+	c.check(key, dst, nil)
+}
+
+// check - reads a string, and stores it if valid returns nil
+func (c *configReader) check(key string, dst *string, valid func(string) error) {
+	v, ok := c.t[key]
+	if !ok {
+		return
+	}
+	s, ok := v.(string)
+	if !ok {
+		c.fail(key, v, "want a string")
+		return
+	}
+	if valid != nil {
+		if err := valid(s); err != nil {
+			c.errs = append(c.errs, key+": "+err.Error())
+			return
+		}
+	}
+	*dst = s
+}
+
+func (c *configReader) pem(key string, dst *[]byte) {
+	var s string
+	c.str(key, &s)
+	if s != "" {
+		*dst = []byte(s)
+	}
+}
+
+func (c *configReader) bool(key string, dst *bool) {
+	v, ok := c.t[key]
+	if !ok {
+		return
+	}
+	b, ok := v.(bool)
+	if !ok {
+		c.fail(key, v, "want true or false")
+		return
+	}
+	*dst = b
+}
+
+// strs - reads a list of strings, null for an empty list, storing it if every item is valid
+func (c *configReader) strs(key string, dst *[]string, valid func(string) error) {
+	v, ok := c.t[key]
+	if !ok {
+		return
+	}
+	var items []string
+	switch l := v.(type) {
+	case nil:
+	case []string:
+		items = l
+	case []interface{}:
+		for _, item := range l {
+			s, ok := item.(string)
+			if !ok {
+				c.fail(key, item, "want a list of strings")
+				return
+			}
+			items = append(items, s)
+		}
+	default:
+		c.fail(key, v, "want a list of strings")
+		return
+	}
+	for _, s := range items {
+		if err := valid(s); err != nil {
+			c.errs = append(c.errs, key+": "+err.Error())
+			return
+		}
+	}
+	*dst = items
+}
+
+// number - reads a number of any type, JSON numbers are float64
+func (c *configReader) number(key string) (float64, interface{}, bool) {
+	v, ok := c.t[key]
+	if !ok {
+		return 0, nil, false
+	}
+	switch n := v.(type) {
+	case float64:
+		return n, v, true
+	case float32:
+		return float64(n), v, true
+	case int:
+		return float64(n), v, true
+	case int64:
+		return float64(n), v, true
+	case uint16:
+		return float64(n), v, true
+	case uint32:
+		return float64(n), v, true
+	case uint64:
+		return float64(n), v, true
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			return f, v, true
+		}
+	}
+	c.fail(key, v, "want a number")
+	return 0, nil, false
+}
+
+// integer - reads a whole number from 0 to max
+func (c *configReader) integer(key string, max float64) (float64, bool) {
+	f, v, ok := c.number(key)
+	if !ok {
+		return 0, false
+	}
+	if f != math.Trunc(f) || f < 0 || f > max {
+		c.fail(key, v, fmt.Sprintf("want a whole number from 0 to %.0f", max))
+		return 0, false
+	}
+	return f, true
+}
+
+func (c *configReader) uint32(key string, dst *uint32) {
+	if f, ok := c.integer(key, math.MaxUint32); ok {
+		*dst = uint32(f)
+	}
+}
+
+func (c *configReader) int(key string, dst *int, min, max int) {
+	f, ok := c.integer(key, float64(max))
+	if !ok {
+		return
+	}
+	if int(f) < min {
+		c.errs = append(c.errs, fmt.Sprintf("%s: must be at least %d, got %.0f", key, min, f))
+		return
+	}
+	*dst = int(f)
+}
+
+func (c *configReader) uint16(key string, dst *uint16, valid func(uint16) error) {
+	f, ok := c.integer(key, math.MaxUint16)
+	if !ok {
+		return
+	}
+	if err := valid(uint16(f)); err != nil {
+		c.errs = append(c.errs, key+": "+err.Error())
+		return
+	}
+	*dst = uint16(f)
+}
+
+func (c *configReader) float(key string, dst *float64, min, max float64) {
+	f, v, ok := c.number(key)
+	if !ok {
+		return
+	}
+	if math.IsNaN(f) || f < min || f > max {
+		if max == math.MaxFloat64 {
+			c.fail(key, v, fmt.Sprintf("want a number of at least %g", min))
+		} else {
+			c.fail(key, v, fmt.Sprintf("want a number from %g to %g", min, max))
+		}
+		return
+	}
+	*dst = f
+}
+
+// duration - reads a duration string like "1m30s", of at least min
+func (c *configReader) duration(key string, dst *time.Duration, min time.Duration) {
+	v, ok := c.t[key]
+	if !ok {
+		return
+	}
+	var d time.Duration
+	switch s := v.(type) {
+	case string:
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			c.errs = append(c.errs, key+": "+err.Error())
+			return
+		}
+	case time.Duration:
+		d = s
+	default:
+		c.fail(key, v, `want a duration like "1m30s"`)
+		return
+	}
+	if d < min {
+		c.errs = append(c.errs, fmt.Sprintf("%s: must be at least %v, got %v", key, min, d))
+		return
+	}
+	*dst = d
+}
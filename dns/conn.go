@@ -0,0 +1,451 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/awgh/ratnet/api"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+/*
+**  STREAMS:  THE TUNNEL AS A net.Conn, FOR ANYTHING THAT ISN'T A RATNET RPC
+**
+**  Dial starts a client session and Listen a server, each on a Module of its own made from a
+**  config map like NewFromConfig reads. Every session is then a byte stream instead of RPC
+**  frames, carried in kcp messages that each start with a kind byte:
+**
+**     <streamData><bytes> | <streamClose>
+**
+**  A server session is offered to Accept when its client opens it with a probe, after the
+**  handshake if the server seals, so probes alone never fill the backlog.
+**
+**  Close sends streamClose and waits, up to streamLinger, for kcp to deliver everything written.
+**  The far end reads io.EOF once it has read what came before, and a server forgets the session.
+**
+**  These Modules have no ratnet node to pass RPCs to, only a streamNode that drops their events.
+ */
+
+// kcp message kinds in a stream session
+const (
+	streamData  = 0
+	streamClose = 1
+)
+
+var (
+	// streamLinger - the longest Close waits for written data to be delivered
+	streamLinger = 30 * time.Second
+
+	// streamBacklog - kcp segments a stream can have waiting to go out before Write blocks
+	streamBacklog = 4 * kcp.IKCP_WND_SND
+)
+
+var (
+	// ErrClosed - returned by a stream or listener after Close
+	ErrClosed = errors.New("dns stream closed")
+
+	// ErrSessionExpired - returned by a server stream whose client stopped sending queries
+	ErrSessionExpired = errors.New("dns session expired")
+)
+
+// Addr - one end of a stream, the upstream host or listen address, and the session
+type Addr struct {
+	Host    string
+	Session uint32
+}
+
+// Network - always "dns"
+func (a *Addr) Network() string { return "dns" }
+
+func (a *Addr) String() string { return fmt.Sprintf("%s/%08x", a.Host, a.Session) }
+
+// Dial : starts a session to upstream with a Module made from cfg, and returns it as a stream
+// Gives up on an upstream that doesn't answer after the RPCTimeout in cfg
+func Dial(upstream string, cfg map[string]interface{}) (net.Conn, error) {
+	m, err := NewFromConfig(streamNode{}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := m.initClient(upstream)
+	if err != nil {
+		return nil, err
+	}
+	local := &Addr{Session: client.id}
+	remote := &Addr{Host: upstream, Session: client.id}
+	c := newStreamConn(client.kcp, &client.mutex, func() int { return client.maxMsgSize }, local, remote)
+	client.conn = c // before its loops start, the server can write first
+
+	ctx := context.Background()
+	if m.RPCTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.RPCTimeout)
+		defer cancel()
+	}
+	if _, err := m.acquireClient(ctx, upstream); err != nil {
+		m.Stop()
+		if err == context.DeadlineExceeded {
+			err = os.ErrDeadlineExceeded
+		}
+		return nil, &net.OpError{Op: "dial", Net: "dns", Addr: remote, Err: err}
+	}
+	c.onClose = func() {
+		m.releaseClient(client)
+		m.Stop()
+	}
+	return c, nil
+}
+
+// Listen : starts a server on addr with a Module made from cfg, and returns a listener for its sessions as streams
+func Listen(addr string, cfg map[string]interface{}) (net.Listener, error) {
+	m, err := NewFromConfig(streamNode{}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{m: m, accept: make(chan *streamConn, channelSize), done: make(chan struct{})}
+	m.listener = l
+	if err := m.Start(addr, false); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// listener - hands out the server's sessions as streams
+type listener struct {
+	m      *Module
+	accept chan *streamConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Accept : waits for the next client session
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close : stops the server, ending every stream it accepted
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.m.Stop()
+	})
+	return nil
+}
+
+// Addr : the UDP address the server listens on
+func (l *listener) Addr() net.Addr {
+	l.m.serverMutex.Lock()
+	defer l.m.serverMutex.Unlock()
+	for _, server := range l.m.servers {
+		if server.PacketConn != nil {
+			return server.PacketConn.LocalAddr()
+		}
+	}
+	return &Addr{Host: l.m.ListenStr}
+}
+
+// offer - starts a stream for a server session the client has opened, and queues it for Accept
+func (l *listener) offer(m *Module, s *session) {
+	local := &Addr{Host: m.ListenStr, Session: s.id}
+	remote := &Addr{Session: s.id}
+	conn := newStreamConn(s.kcp, &s.mutex, func() int { return s.msgSize(m.sealOverhead()) }, local, remote)
+	conn.onClose = func() {
+		m.sessionsMutex.Lock()
+		if m.sessions[s.id] == s {
+			delete(m.sessions, s.id)
+		}
+		m.sessionsMutex.Unlock()
+	}
+	s.mutex.Lock()
+	if s.conn != nil { // a resolver sent the open probe again
+		s.mutex.Unlock()
+		return
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+	select {
+	case l.accept <- conn:
+	default:
+		conn.lose(errors.New("dns listener backlog full"))
+	}
+}
+
+// streamNode - the node of a Module made by Dial or Listen, it takes events and drops them
+// A debug build of ratnet sends every event to the node, streams never pass it anything else
+type streamNode struct {
+	api.Node
+}
+
+var (
+	streamEvents     chan api.Event
+	streamEventsOnce sync.Once
+)
+
+// Events : a channel that is always drained
+func (streamNode) Events() chan api.Event {
+	streamEventsOnce.Do(func() {
+		streamEvents = make(chan api.Event, channelSize)
+		go func() {
+			for range streamEvents {
+			}
+		}()
+	})
+	return streamEvents
+}
+
+// streamConn - one end of a session as a net.Conn
+type streamConn struct {
+	kcp      *kcp.KCP
+	kcpMutex *sync.Mutex // the session's, guards kcp
+	msgSize  func() int  // the largest kcp message the session carries
+	local    net.Addr
+	remote   net.Addr
+	onClose  func() // tears down the session once Close has flushed it
+
+	readable chan struct{} // signalled when kcp has messages, or a deadline changes
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex         sync.Mutex // guards everything below
+	buf           []byte     // the rest of a message partly read
+	eof           bool       // the far end closed
+	err           error      // why closed was closed
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	writeMutex sync.Mutex // keeps writes whole
+}
+
+func newStreamConn(k *kcp.KCP, kcpMutex *sync.Mutex, msgSize func() int, local, remote net.Addr) *streamConn {
+	return &streamConn{
+		kcp:      k,
+		kcpMutex: kcpMutex,
+		msgSize:  msgSize,
+		local:    local,
+		remote:   remote,
+		readable: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// signal - wakes a blocked Read, without blocking
+func (c *streamConn) signal() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// lose - ends the stream without a Close, when the session or module is gone
+func (c *streamConn) lose(err error) {
+	c.once.Do(func() {
+		c.mutex.Lock()
+		c.err = err
+		c.mutex.Unlock()
+		close(c.closed)
+	})
+}
+
+// isClosed - true once the stream has ended, by Close or by losing its session
+func (c *streamConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read : reads stream data, returning io.EOF once the far end has closed and everything before it is read
+func (c *streamConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		c.mutex.Lock()
+		c.fill()
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		eof, deadline := c.eof, c.readDeadline
+		c.mutex.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+		if eof {
+			return 0, io.EOF
+		}
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// fill - takes kcp messages until there is data to read or the far end has closed, with mutex held
+func (c *streamConn) fill() {
+	c.kcpMutex.Lock()
+	defer c.kcpMutex.Unlock()
+	for len(c.buf) == 0 && !c.eof {
+		n := c.kcp.PeekSize()
+		if n <= 0 {
+			return
+		}
+		msg := make([]byte, n)
+		if c.kcp.Recv(msg) <= 0 {
+			return
+		}
+		switch msg[0] {
+		case streamData:
+			c.buf = msg[1:]
+		case streamClose:
+			c.eof = true
+		}
+	}
+}
+
+// wait - waits for ch, for the stream to close, or for deadline
+func (c *streamConn) wait(ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-c.closed:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.err
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Write : queues b in kcp, in messages as large as the session carries
+// Blocks while more than streamBacklog segments are waiting to go out
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	n := 0
+	for n < len(b) {
+		if err := c.writable(); err != nil {
+			return n, err
+		}
+		size := c.msgSize() - 1
+		if size > len(b)-n {
+			size = len(b) - n
+		}
+		msg := make([]byte, 1+size)
+		msg[0] = streamData
+		copy(msg[1:], b[n:n+size])
+		if err := c.send(msg); err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
+}
+
+// writable - waits until kcp has room for more, the stream closes, or the write deadline passes
+func (c *streamConn) writable() error {
+	for {
+		select {
+		case <-c.closed:
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			return c.err
+		default:
+		}
+		c.kcpMutex.Lock()
+		waiting := c.kcp.WaitSnd()
+		c.kcpMutex.Unlock()
+		if waiting < streamBacklog {
+			return nil
+		}
+		c.mutex.Lock()
+		deadline := c.writeDeadline
+		c.mutex.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+}
+
+func (c *streamConn) send(msg []byte) error {
+	c.kcpMutex.Lock()
+	defer c.kcpMutex.Unlock()
+	if c.kcp.Send(msg) < 0 {
+		return errors.New("dns stream message too large for kcp")
+	}
+	return nil
+}
+
+// Close : tells the far end, waits up to streamLinger for everything written to be delivered, and ends the session
+func (c *streamConn) Close() error {
+	if c.isClosed() {
+		return nil
+	}
+	c.writeMutex.Lock()
+	err := c.send([]byte{streamClose})
+	c.writeMutex.Unlock()
+	for deadline := time.Now().Add(streamLinger); err == nil && !c.isClosed() && time.Now().Before(deadline); {
+		c.kcpMutex.Lock()
+		waiting := c.kcp.WaitSnd()
+		c.kcpMutex.Unlock()
+		if waiting == 0 {
+			break
+		}
+		time.Sleep(15 * time.Millisecond)
+	}
+	c.lose(ErrClosed)
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return nil
+}
+
+// LocalAddr : this end of the session
+func (c *streamConn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr : the far end of the session
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline : sets both the read and write deadlines
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline : makes Read give up with os.ErrDeadlineExceeded at t, zero for never
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	c.signal() // a blocked Read picks up the new deadline
+	return nil
+}
+
+// SetWriteDeadline : makes a blocked Write give up with os.ErrDeadlineExceeded at t, zero for never
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeDeadline = t
+	c.mutex.Unlock()
+	return nil
+}
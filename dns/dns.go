@@ -1,32 +1,71 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/awgh/bencrypt/bc"
 	mdns "github.com/miekg/dns"
 	kcp "github.com/xtaci/kcp-go"
 
-	"github.com/awgh/debouncer"
 	"github.com/awgh/ratnet"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
 )
 
 const (
-	// mtu - the effective mtu inside the DNS tunnel
+	// mtu - the effective mtu inside the DNS tunnel, unless probing finds a better one
 	mtu = 150
 
-	// maxMsgSize - the maximum size of a single message
+	// maxMsgSize - the maximum size of a single message at the default mtu
 	maxMsgSize = 2889
+
+	// defaultByteLimit - the bundle size limit at the default mtu, leaving room in a message for the RemoteCall around it
+	defaultByteLimit = 2410
+
+	// scrubName - replaces the question name in direct mode responses, to save space
+	scrubName = "mail."
+
+	// channelSize - size of all channels created
+	channelSize = 200
+
+	// defaultRecordType - the record type clients query for, unless configured otherwise
+	defaultRecordType = "TXT"
 )
 
+// defaultAlphabets - name codecs clients try at session start, base32 works everywhere
+var defaultAlphabets = []string{"binary", "base36", "base32"}
+
 var (
-	clientTimeout = 4 * time.Second
-	serverTimeout = 3 * time.Second
+	// ErrNoUpstream - returned by RPC when no host is given and neither UpstreamStr nor Resolvers is set
+	ErrNoUpstream = errors.New("dns upstream not set")
+
+	// ErrStopped - returned by RPCs still waiting when the module is stopped
+	ErrStopped = errors.New("dns transport stopped")
+
+	// ErrSessionLost - returned by a client stream, or an RPC sent twice, when the server has forgotten the session
+	ErrSessionLost = errors.New("dns session lost by the server")
+)
+
+var (
+	clientTimeout      = 4 * time.Second
+	probeRetryInterval = time.Second // between session starts for a host that doesn't answer
+	serverTimeout      = 3 * time.Second
+	sessionTimeout     = 2 * time.Minute
+	defaultRPCTimeout  = 60 * time.Second
+)
+
+const (
+	// defaultEDNSSize - the EDNS0 buffer size recommended by DNS flag day 2020
+	defaultEDNSSize = 1232
 )
 
 func init() {
@@ -35,56 +74,85 @@ func init() {
 
 // Module : DNS Implementation of a Transport module
 type Module struct {
-	node                             api.Node
-	isRunningClient, isRunningServer uint32
-	byteLimit                        int64
+	node            api.Node
+	isRunningServer uint32
+	byteLimit       int64  // atomic, from SetByteLimit, or else the smallest any probed session carries
+	requestID       uint32 // last RPC request ID used, atomic
+	lastStats       int64  // unix nanoseconds stats were last emitted, atomic
+	counters        counters
 
 	ListenStr, UpstreamStr string
 	ClientConv, ServerConv uint32
-
-	kcpClient, kcpServer *kcp.KCP
-	server               *mdns.Server
-	wgClient             sync.WaitGroup
-	wgServer             sync.WaitGroup
-	clientsByHost        map[string]*kcp.KCP
-
-	debouncerClientUpdate *debouncer.Debouncer
-	debouncerServerUpdate *debouncer.Debouncer
-	adminMode             bool
-
-	// channels
-	upstreamKCPData   chan []byte
-	downstreamKCPData chan []byte
-	respchan          chan api.RemoteResponse
+	RecordType             string        // record type used for downstream data in this node's client sessions
+	Domain                 string        // tunnel domain delegated to the server, like "t.example.org.", empty for direct mode
+	RPCTimeout             time.Duration // deadline for RPC calls, zero waits forever
+	EDNSSize               uint16        // EDNS0 buffer size the client advertises, zero to not use EDNS0
+	DoHMethod              string        // "POST" or "GET", for upstream hosts that are DoH URLs
+	HTTPClient             *http.Client  // client for DoH requests, nil for http.DefaultClient
+	TLSListenStr           string        // address the server also listens on for DoT, like ":853", empty for none
+	Cert, Key              []byte        // PEM certificate and key for DoT, generated self-signed if empty
+	TLSPins                []string      // CertPin values, one of which a DoT server must match, empty to verify normally
+	Alphabets              []string      // names of the NameCodecs clients try at session start, densest first
+	ProbeMTU               bool          // measure the path at session start, instead of using the default mtu
+	PollInterval           time.Duration // delay between polls while kcp has data in flight
+	PollMaxInterval        time.Duration // ceiling for the delay between polls when idle
+	PollJitter             float64       // random fraction added to or taken from each poll delay
+	MaxQPS                 float64       // most queries per second this module sends, zero for no limit
+	StatsInterval          time.Duration // how often Stats are emitted as events, in debug builds where ratnet delivers them, zero for never
+	Encrypt                bool          // seal every kcp segment with keys from a session handshake, both ends must agree
+	SessionKey             bc.KeyPair    // the server's ECC key for handshakes, like the node's routing key, generated by New
+	ServerKey              string        // base64 ECC public key a server must prove it holds, empty to trust the first one each host sends
+	TSIGKeyName            string        // name of the TSIG key shared with tunnel peers
+	TSIGSecret             string        // base64 HMAC-SHA256 secret that signs every message, empty to not use TSIG
+	DataShards             int           // kcp packets per FEC group in this node's client sessions
+	ParityShards           int           // FEC parity packets sent after each group, zero to not use FEC
+	Compress               bool          // compress RPC frames in sessions, clients ask for it and servers agree, both ends must have it set
+	SourceQPS              float64       // queries a second the server answers from one address, zero for no limit
+	MaxSources             int           // addresses SourceQPS keeps track of, past that queries from new ones are over it, zero for no limit
+	SessionQPS             float64       // queries a second the server answers for one session, zero for no limit
+	MaxHeldQueries         int           // queries the server holds waiting on downstream data, zero for no limit
+	MaxQuerySize           int           // largest query message the server answers, in bytes, zero for no limit
+	LimitAction            string        // LimitRefuse or LimitDrop, what the server does with queries over a limit
+	Resolvers              []string      // resolvers every client session spreads its queries over, whatever host RPC is given, empty to send them to the session's host
+	ResolverPolicy         string        // PolicyRoundRobin or PolicyWeighted, how queries are spread over Resolvers
+	ResolverFailures       int           // failures in a row that take a resolver out of the pool
+	ResolverRetry          time.Duration // how long a resolver is out of the pool before it is tried again
+	HoldTimeout            time.Duration // longest the server holds a query waiting on downstream data, under resolver timeouts
+	Polls                  int           // queries each client session keeps in flight, so the server has one to answer with
+	MaxInFlight            int           // most data queries a client session pipelines at once, zero to send them one at a time from the poll loops
+
+	servers       []*mdns.Server
+	wgServer      sync.WaitGroup
+	clientsByHost map[string]*clientSession
+	sessions      map[uint32]*session
+	adminMode     bool
 
 	// mutexes
-	clientMutex sync.Mutex
-	serverMutex sync.Mutex
+	clientMutex   sync.Mutex
+	serverMutex   sync.Mutex
+	sessionsMutex sync.Mutex
+	throttleMutex sync.Mutex // guards nextQuery
+	keyMutex      sync.Mutex // guards SessionKey, generating it, and serverKeys
+	limitMutex    sync.Mutex // guards byteLimitSet and byteLimitProbed, and changing byteLimit
+
+	nextQuery time.Time // earliest time the next query can go out under MaxQPS
+	limits    limits
+	pool      resolverPool
+	listener  *listener // set by Listen, makes every server session a stream
+
+	serverKeys map[string][]byte // by host, the key each sent first, when ServerKey is empty
+
+	byteLimitSet    bool // SetByteLimit was called, probes leave byteLimit alone
+	byteLimitProbed bool // a probed session has set byteLimit
 }
 
 // NewFromMap : Makes a new instance of this transport module from a map of arguments (for deserialization support)
+// Bad values are reported through events and left at their defaults, use NewFromConfig to get the error back instead
 func NewFromMap(node api.Node, t map[string]interface{}) api.Transport {
-	listenStr := ""
-	upstreamStr := ""
-	clientConv := uint32(0xFFFFFFFF)
-	serverConv := uint32(0xFFFFFFFF)
-	if _, ok := t["ListenStr"]; ok {
-		listenStr = t["ListenStr"].(string)
-	}
-	if _, ok := t["UpstreamStr"]; ok {
-		upstreamStr = t["UpstreamStr"].(string)
-	}
-	if _, ok := t["ClientConv"]; ok {
-		clientConv = t["ClientConv"].(uint32)
-	}
-	if _, ok := t["ServerConv"]; ok {
-		serverConv = t["ServerConv"].(uint32)
+	instance := New(node, 0xFFFFFFFF, 0xFFFFFFFF)
+	if err := instance.configure(t); err != nil {
+		events.Error(node, err.Error())
 	}
-
-	instance := New(node, clientConv, serverConv)
-	instance.UpstreamStr = upstreamStr
-	instance.ListenStr = listenStr
-
 	return instance
 }
 
@@ -95,27 +163,41 @@ func New(node api.Node, clientConv uint32, serverConv uint32) *Module {
 
 	instance.ClientConv = clientConv
 	instance.ServerConv = serverConv
-
-	// size of for all channels created
-	channelSize := 200
-
-	instance.respchan = make(chan api.RemoteResponse, channelSize)
-
-	instance.upstreamKCPData = make(chan []byte, channelSize)
-	instance.downstreamKCPData = make(chan []byte, channelSize)
+	instance.RecordType = defaultRecordType
+	instance.RPCTimeout = defaultRPCTimeout
+	instance.EDNSSize = defaultEDNSSize
+	instance.DoHMethod = http.MethodPost
+	instance.Alphabets = defaultAlphabets
+	instance.ProbeMTU = true
+	instance.PollInterval = defaultPollInterval
+	instance.PollMaxInterval = defaultPollMaxInterval
+	instance.PollJitter = defaultPollJitter
+	instance.MaxQPS = defaultMaxQPS
+	instance.StatsInterval = defaultStatsInterval
+	instance.Encrypt = true
+	instance.SessionKey = newSessionKey() // now, so MarshalJSON saves it and a restart keeps it
+	instance.Compress = true
+	instance.TSIGKeyName = defaultTSIGKeyName
+	instance.DataShards = defaultDataShards
+	instance.SourceQPS = defaultSourceQPS
+	instance.MaxSources = defaultMaxSources
+	instance.SessionQPS = defaultSessionQPS
+	instance.MaxHeldQueries = defaultMaxHeldQueries
+	instance.MaxQuerySize = defaultMaxQuerySize
+	instance.LimitAction = LimitRefuse
+	instance.ResolverPolicy = PolicyRoundRobin
+	instance.ResolverFailures = defaultResolverFailures
+	instance.ResolverRetry = defaultResolverRetry
+	instance.HoldTimeout = serverTimeout
+	instance.Polls = defaultPolls
+	instance.MaxInFlight = defaultMaxInFlight
 
 	// Client is for client connections (from me) and server responses (from remote)
-	// Server is for server connections (from remote) and my responses (from me)
-	instance.clientsByHost = make(map[string]*kcp.KCP)
+	// Sessions are for server connections (from remote) and my responses (from me), one per remote client
+	instance.clientsByHost = make(map[string]*clientSession)
+	instance.sessions = make(map[uint32]*session)
 
-	instance.byteLimit = 2410
-
-	instance.debouncerServerUpdate = debouncer.New(20*time.Millisecond, func() {
-		instance.serverUpdate()
-	})
-	instance.debouncerClientUpdate = debouncer.New(20*time.Millisecond, func() {
-		instance.clientUpdate()
-	})
+	instance.byteLimit = defaultByteLimit
 
 	return instance
 }
@@ -126,181 +208,426 @@ func (m *Module) Name() string {
 }
 
 // MarshalJSON : Create a serialied representation of the config of this module
+// The SessionKey private key, TSIGSecret and DoT Key are in it in plaintext, store it like a private key
 func (m *Module) MarshalJSON() (b []byte, e error) {
-	return json.Marshal(map[string]interface{}{
-		"Transport": "dns",
-	})
+	return json.Marshal(m.configMap())
 }
 
 // ByteLimit - get limit on bytes per bundle for this transport
-func (m *Module) ByteLimit() int64 { return m.byteLimit }
+func (m *Module) ByteLimit() int64 { return atomic.LoadInt64(&m.byteLimit) }
+
+// SetByteLimit - set limit on bytes per bundle for this transport, it stays whatever sessions are probed after
+func (m *Module) SetByteLimit(limit int64) {
+	m.limitMutex.Lock()
+	defer m.limitMutex.Unlock()
+	m.byteLimitSet = true
+	atomic.StoreInt64(&m.byteLimit, limit)
+}
 
-// SetByteLimit - set limit on bytes per bundle for this transport
-func (m *Module) SetByteLimit(limit int64) { m.byteLimit = limit }
+// probedByteLimit - lowers the byte limit to what a newly probed session carries, the first sets it, unless SetByteLimit was called
+// Bundles go to every host, so the limit is the smallest any session carries
+func (m *Module) probedByteLimit(limit int64) {
+	m.limitMutex.Lock()
+	defer m.limitMutex.Unlock()
+	if m.byteLimitSet {
+		return
+	}
+	if !m.byteLimitProbed || limit < atomic.LoadInt64(&m.byteLimit) {
+		atomic.StoreInt64(&m.byteLimit, limit)
+	}
+	m.byteLimitProbed = true
+}
 
-// Listen : opens a UDP socket and listens
+// Listen : opens UDP and TCP sockets and listens, and DoT too if TLSListenStr is set
+// Errors are emitted through events, use Start to get them back instead
 func (m *Module) Listen(listen string, adminMode bool) {
+	if err := m.Start(listen, adminMode); err != nil {
+		events.Error(m.node, err.Error())
+	}
+}
+
+// Start : like Listen, but returns an error if the server is already listening or a socket can't be opened
+func (m *Module) Start(listen string, adminMode bool) error {
+	m.serverMutex.Lock()
+	defer m.serverMutex.Unlock()
+
+	if len(m.servers) > 0 {
+		return errors.New("dns server already listening on " + m.ListenStr)
+	}
 	m.ListenStr = listen
 	m.adminMode = adminMode
-	go m.serve("udp", listen, adminMode)
+
+	// bind everything up front, so failures come back to the caller
+	servers, err := m.bind(listen)
+	if err != nil {
+		return err
+	}
+	m.servers = servers
+
+	m.startServer()
+	var started sync.WaitGroup
+	for _, server := range servers {
+		started.Add(1)
+		go m.serve(server, &started)
+	}
+	started.Wait()
+	return nil
 }
 
-// Stop : Stops module
+// Stop : Stops module, both the server and any client sessions
 func (m *Module) Stop() {
 	m.stopServer()
+	m.stopClients()
 }
 
 // Private / Internal Methods
 
-func (m *Module) serve(net, addr string, adminMode bool) {
-	m.kcpServer = kcp.NewKCP(m.ServerConv,
-		func(buf []byte, size int) {
-			if size > 0 {
-				b := make([]byte, size)
-				copy(b, buf[:size])
-				m.downstreamKCPData <- b
+// bind - opens the server sockets, or none of them if any one fails
+func (m *Module) bind(listen string) ([]*mdns.Server, error) {
+	handler := mdns.HandlerFunc(m.handleDNS)
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	secrets := m.tsigSecrets()
+	servers := []*mdns.Server{{PacketConn: pc, Handler: handler, UDPSize: mdns.DefaultMsgSize, TsigSecret: secrets}}
+
+	l, err := net.Listen("tcp", listen) // for responses too big for a datagram
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	servers = append(servers, &mdns.Server{Listener: l, Handler: handler, TsigSecret: secrets})
 
+	if m.TLSListenStr != "" {
+		config, err := m.tlsServerConfig()
+		if err == nil {
+			l, err = tls.Listen("tcp", m.TLSListenStr, config)
+		}
+		if err != nil {
+			for _, server := range servers {
+				closeServer(server)
 			}
-		})
-	m.kcpServer.SetMtu(mtu) // ((5/8) * 253) -8
-	// NoDelay options
-	// fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
-	// nodelay: 0:disable(default), 1:enable
-	// interval: internal update timer interval in millisec, default is 100ms
-	// resend: 0:disable fast resend(default), 1:enable fast resend
-	// nc: 0:normal congestion control(default), 1:disable congestion control
-	// m.kcpServer.NoDelay(1, 20, 2, 1)
-	m.kcpServer.NoDelay(0, 20, 0, 1)
+			return nil, errors.New("Failed to setup the DoT server: " + err.Error())
+		}
+		servers = append(servers, &mdns.Server{Listener: l, Net: "tcp-tls", Handler: handler, TsigSecret: secrets})
+	}
+	return servers, nil
+}
 
-	m.wgServer.Add(1)
-	m.setIsRunningServer(true)
+// serve - runs a bound server until it is shut down, marking started once it is up
+func (m *Module) serve(server *mdns.Server, started *sync.WaitGroup) {
+	var once sync.Once
+	server.NotifyStartedFunc = func() { once.Do(started.Done) }
+	err := server.ActivateAndServe()
+	once.Do(started.Done)
+	if err != nil {
+		events.Error(m.node, "dns server failed: "+err.Error())
+	}
+}
 
+// closeServer - closes the socket of a server that was never started
+func closeServer(server *mdns.Server) {
+	if server.PacketConn != nil {
+		server.PacketConn.Close()
+	}
+	if server.Listener != nil {
+		server.Listener.Close()
+	}
+}
+
+// startServer - starts the clock for server sessions, if it isn't already running
+func (m *Module) startServer() {
+	if !atomic.CompareAndSwapUint32(&m.isRunningServer, 0, 1) {
+		return
+	}
+
+	m.wgServer.Add(1)
 	go func() {
 		defer m.wgServer.Done()
 
 		for m.IsRunningServer() {
 			time.Sleep(time.Millisecond * 15)
-			m.serverMutex.Lock()
-			m.kcpServer.Update()
-			m.serverMutex.Unlock()
+			m.updateSessions()
+			m.pruneLimits()
+			m.emitStats()
 		}
 	}()
+}
 
-	serveMux := mdns.NewServeMux()
-	serveMux.HandleFunc(".", func(w mdns.ResponseWriter, req *mdns.Msg) {
-		m.handleDNS(w, req)
-	})
+// initClient - returns the client session for host, making a new one if needed
+func (m *Module) initClient(host string) (*clientSession, error) {
+	if host == "" {
+		return nil, ErrNoUpstream
+	}
 
-	m.serverMutex.Lock()
-	m.server = &mdns.Server{Addr: addr, Net: net, TsigSecret: nil, Handler: serveMux}
-	m.serverMutex.Unlock()
-	err := m.server.ListenAndServe()
-	if err != nil {
-		log.Fatalf("Failed to setup the %s server: %v\n", net, err)
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+
+	client, ok := m.clientsByHost[host]
+	if !ok || client.isLost() { // the one the server forgot is discarded when its last call ends
+		client = &clientSession{
+			host:            host,
+			id:              newSessionID(),
+			upstreamKCPData: make(chan []byte, channelSize),
+			wake:            make(chan struct{}, 1),
+			pending:         make(map[uint32]chan api.RemoteResponse),
+			done:            make(chan struct{}),
+			lost:            make(chan struct{}),
+			window:          newFlightWindow(),
+		}
+		client.kcp = kcp.NewKCP(m.ClientConv,
+			func(buf []byte, size int) {
+				if size > 0 {
+					b := make([]byte, size)
+					copy(b, buf[:size])
+					m.count(&client.counters, statRetransmits, client.resent.count(b))
+					for _, p := range m.wrapPacket(client.sealer, client.fec, b) {
+						client.upstreamKCPData <- p
+					}
+					client.signal()
+				}
+			})
+		client.kcp.SetMtu(m.upstreamMTU(base32Codec) - m.sealOverhead()) // until negotiateCodec picks one
+		client.kcp.NoDelay(0, 20, 0, 1)
+		m.clientsByHost[host] = client
 	}
+	return client, nil
 }
 
-func (m *Module) initClient() {
-	if m.UpstreamStr == "" {
-		log.Fatal("Upstream not set")
+// acquireClient - starts the client for host if needed, and counts one more call in flight
+// A host that doesn't answer is tried again until it does, ctx is done, or the module stops
+func (m *Module) acquireClient(ctx context.Context, host string) (*clientSession, error) {
+	for {
+		client, err := m.initClient(host)
+		if err != nil {
+			return nil, err
+		}
+		client.lifeMutex.Lock()
+		if client.closed { // lost a race with releaseClient, get the new one
+			client.lifeMutex.Unlock()
+			continue
+		}
+		client.calls++
+		if err := m.startClient(ctx, client); err == errNoAnswer {
+			client.calls--
+			client.lifeMutex.Unlock()
+			select {
+			case <-time.After(probeRetryInterval):
+				continue
+			case <-client.done:
+				return nil, ErrStopped
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else if err != nil {
+			if unanswered(err) { // the probe ctx cut short may have changed the session on the server, so the next call starts a new one
+				client.timedOut = true
+			}
+			client.lifeMutex.Unlock()
+			m.releaseClient(client)
+			return nil, err
+		}
+		client.lifeMutex.Unlock()
+		return client, nil
 	}
+}
 
-	if !m.IsRunningClient() {
-
-		client, ok := m.clientsByHost[m.UpstreamStr]
-
-		if !ok {
-			kcpClient := kcp.NewKCP(m.ClientConv,
-				func(buf []byte, size int) {
-					if size > 0 {
-						b := make([]byte, size)
-						copy(b, buf[:size])
-						m.upstreamKCPData <- b
-
-					}
-				})
-			kcpClient.SetMtu(mtu) // ((5/8) * 253) -8
-			kcpClient.NoDelay(0, 20, 0, 1)
-			m.clientMutex.Lock()
-			m.kcpClient = kcpClient
-			m.clientMutex.Unlock()
-			m.clientsByHost[m.UpstreamStr] = kcpClient
-		} else {
-			m.clientMutex.Lock()
-			m.kcpClient = client
-			m.clientMutex.Unlock()
+// releaseClient - counts one less call in flight, and stops the client when none are left
+// A client that timed out, or that the server has forgotten, is discarded, so the next call starts over with a fresh session
+func (m *Module) releaseClient(client *clientSession) {
+	client.lifeMutex.Lock()
+	defer client.lifeMutex.Unlock()
+	client.calls--
+	if client.calls > 0 {
+		return
+	}
+	m.stopClient(client)
+	if client.timedOut || client.isLost() {
+		client.closed = true
+		client.mutex.Lock()
+		client.kcp.ReleaseTX()
+		client.mutex.Unlock()
+
+		m.clientMutex.Lock()
+		if m.clientsByHost[client.host] == client {
+			delete(m.clientsByHost, client.host)
 		}
+		m.clientMutex.Unlock()
+		events.Info(m.node, "Client discarded for "+client.host)
 	}
 }
 
-func (m *Module) startClient() {
-	if !m.IsRunningClient() {
+func (m *Module) startClient(ctx context.Context, client *clientSession) error {
+	if !client.IsRunning() {
+
+		events.Info(m.node, "Starting Client for "+client.host)
 
-		events.Info(m.node, "Starting Client")
+		if !client.probed {
+			if err := m.probePath(ctx, client); err != nil {
+				select {
+				case <-client.done:
+					return ErrStopped
+				default:
+					return err
+				}
+			}
+		}
 
-		m.setIsRunningClient(true)
+		client.setIsRunning(true)
 
-		m.wgClient.Add(1)
+		client.wg.Add(1)
 		go func() {
-			defer m.wgClient.Done()
-			for m.IsRunningClient() {
+			defer client.wg.Done()
+			for client.IsRunning() {
 				time.Sleep(time.Millisecond * 15)
-				m.clientMutex.Lock()
-				m.kcpClient.Update()
-				m.clientMutex.Unlock()
+				client.mutex.Lock()
+				client.kcp.Update()
+				if packets := m.flushPackets(client.sealer, client.fec); len(packets) > 0 {
+					for _, p := range packets {
+						client.upstreamKCPData <- p
+					}
+					client.signal()
+				}
+				client.mutex.Unlock()
+				m.emitStats()
 			}
 			events.Info(m.node, "Client Update Loop Stopped")
 		}()
 
-		m.wgClient.Add(1)
-		go func() {
-			defer m.wgClient.Done()
-			for m.IsRunningClient() {
-				m.feedUpstream(true)
-				time.Sleep(20 * time.Millisecond)
-			}
-			events.Info(m.node, "feedUpstream Loop Stopped")
-		}()
+		// pipelined data goes out as it comes, leaving the poll loops to poll
+		pipelined := m.MaxInFlight > 0
+		if pipelined {
+			client.wg.Add(1)
+			go func() {
+				defer client.wg.Done()
+				m.pumpUpstream(client)
+			}()
+		}
+
+		// each loop has one query in flight at a time, the server holds the polls until it has data
+		polls := m.Polls
+		if polls < 1 {
+			polls = 1
+		}
+		for i := 0; i < polls; i++ {
+			client.wg.Add(1)
+			go func() {
+				defer client.wg.Done()
+				schedule := m.newPollScheduler()
+				for client.IsRunning() && !client.isLost() {
+					var active bool
+					if pipelined {
+						_, active = m.pollUpstream(client)
+					} else {
+						_, active = m.feedUpstream(client, true)
+					}
+					select {
+					case <-time.After(schedule.next(active || m.clientBusy(client))):
+					case <-client.wake:
+					}
+				}
+				events.Info(m.node, "feedUpstream Loop Stopped")
+			}()
+		}
 	}
+	return nil
 }
 
-func (m *Module) stopClient() {
-	if m.IsRunningClient() {
-		events.Info(m.node, "Stopping Client")
-		m.setIsRunningClient(false)
-		m.wgClient.Wait()
-
-		for m.feedUpstream(false) { // these are the ACKs, they need to go out
-			time.Sleep(20 * time.Millisecond)
-			m.clientMutex.Lock()
-			m.kcpClient.Update()
-			m.clientMutex.Unlock()
+func (m *Module) stopClient(client *clientSession) {
+	if client.IsRunning() {
+		events.Info(m.node, "Stopping Client for "+client.host)
+		client.setIsRunning(false)
+		client.signal()
+		client.wg.Wait()
+
+		// these are the ACKs, they need to go out, unless the far end has stopped answering
+		deadline := time.Now().Add(clientTimeout)
+		for !client.timedOut && !client.isLost() && time.Now().Before(deadline) {
+			if again, _ := m.feedUpstream(client, false); !again {
+				break
+			}
+			time.Sleep(m.PollInterval)
+			client.mutex.Lock()
+			client.kcp.Update()
+			client.mutex.Unlock()
 		}
+		client.closePipes()
 
-		m.UpstreamStr = ""
 		events.Info(m.node, "Client Stopped")
 	}
 }
 
 func (m *Module) stopServer() {
-	if m.IsRunningServer() {
-		m.setIsRunningServer(false)
-		m.wgServer.Wait()
-		m.server.Shutdown()
+	m.setIsRunningServer(false)
+	m.wgServer.Wait()
+
+	m.serverMutex.Lock()
+	for _, server := range m.servers {
+		server.Shutdown()
+	}
+	m.servers = nil
+	m.serverMutex.Unlock()
+
+	// a restarted server starts over, clients are told their sessions are unknown and make new ones
+	m.sessionsMutex.Lock()
+	for _, s := range m.sessions {
+		if conn := s.stream(); conn != nil {
+			conn.lose(ErrStopped)
+		}
 	}
+	m.sessions = make(map[uint32]*session)
+	m.sessionsMutex.Unlock()
 }
 
-// IsRunningClient - returns true if the client is running
-func (m *Module) IsRunningClient() bool {
-	return atomic.LoadUint32(&m.isRunningClient) == 1
+// stopClients - stops and discards every client session, failing any RPCs still waiting
+func (m *Module) stopClients() {
+	m.clientMutex.Lock()
+	clients := m.clientsByHost
+	m.clientsByHost = make(map[string]*clientSession)
+	m.clientMutex.Unlock()
+
+	for _, client := range clients {
+		client.doneOnce.Do(func() { close(client.done) }) // first, so a client still probing gives up
+		client.lifeMutex.Lock()
+		m.stopClient(client)
+		if !client.closed {
+			client.closed = true
+			client.mutex.Lock()
+			client.kcp.ReleaseTX()
+			client.mutex.Unlock()
+		}
+		client.lifeMutex.Unlock()
+	}
 }
 
-func (m *Module) setIsRunningClient(b bool) {
-	var running uint32 = 0
-	if b {
-		running = 1
+// zone - the tunnel domain as a canonical FQDN, or empty in direct mode
+func (m *Module) zone() string {
+	if m.Domain == "" {
+		return ""
+	}
+	return mdns.CanonicalName(strings.TrimPrefix(m.Domain, "."))
+}
+
+// upstreamMTU - the largest KCP packet that fits into one query name spelled with codec
+func (m *Module) upstreamMTU(codec NameCodec) int {
+	if n := maxDotifyLen(codec, querySuffix(queryData, codec, 0, m.zone())); n < mtu {
+		return n
+	}
+	return mtu // ((5/8) * 253) -8
+}
+
+// IsRunningClient - returns true if the client is running for any upstream host
+func (m *Module) IsRunningClient() bool {
+	m.clientMutex.Lock()
+	defer m.clientMutex.Unlock()
+	for _, client := range m.clientsByHost {
+		if client.IsRunning() {
+			return true
+		}
 	}
-	atomic.StoreUint32(&m.isRunningClient, running)
+	return false
 }
 
 // IsRunningServer - returns true if the server is running
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// a resolver that mangles the case of query names like DNS 0x20, flipping every letter so it's repeatable
+func caseRandomizingProxy(t *testing.T, listen, upstream string) *mdns.Server {
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		q := req.Copy()
+		name := []byte(q.Question[0].Name)
+		for i, c := range name {
+			if c >= 'a' && c <= 'z' {
+				name[i] = c - ('a' - 'A')
+			} else if c >= 'A' && c <= 'Z' {
+				name[i] = c + ('a' - 'A')
+			}
+		}
+		q.Question[0].Name = string(name)
+		r, err := exchange(q)
+		if err != nil {
+			return nil
+		}
+		r.Question = req.Question
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_NameCodec_0x20_1(t *testing.T) {
+
+	serverKey, routingKey := new(ecc.KeyPair), new(ecc.KeyPair)
+	serverKey.GenerateKey()
+	routingKey.GenerateKey()
+	node := ram.New(serverKey, routingKey)
+	server := dns.New(node, 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30355", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+	proxy := caseRandomizingProxy(t, "127.0.0.1:30356", "127.0.0.1:30355")
+	defer proxy.Shutdown()
+
+	// binary labels don't survive the proxy, so the client has to notice and settle for base36
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.RPCTimeout = 30 * time.Second
+	defer client.Stop()
+	v, err := client.RPC("127.0.0.1:30356", api.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	id, err := node.ID()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if key, ok := v.(*ecc.PubKey); !ok || key.ToB64() != id.ToB64() {
+		t.Fatalf("RPC through a 0x20 resolver returned the wrong ID: %+v", v)
+	}
+}
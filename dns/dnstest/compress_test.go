@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Compress_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30381", true); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	pub := key.GetPubKey().ToB64()
+
+	// a call and a response that compress well, both ways
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	name := strings.Repeat("compressible ", 300)
+	if _, err := client.RPC("127.0.0.1:30381", api.AddContact, name, pub); err != nil {
+		t.Fatal(err.Error())
+	}
+	value, err := client.RPC("127.0.0.1:30381", api.GetContacts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if contacts, ok := value.([]api.Contact); !ok || len(contacts) != 1 || contacts[0].Name != name {
+		t.Fatal("contacts lost or changed on the way through: ", value)
+	}
+	cs, ss := client.Stats(), server.Stats()
+	client.Stop()
+	if cs.CompressionRatio() < 2 || ss.CompressionRatio() < 2 {
+		t.Fatal("frames not compressed: ", cs.CompressionRatio(), ss.CompressionRatio())
+	}
+	if !strings.Contains(cs.String(), "compression ") {
+		t.Fatal("compression ratio missing from stats: ", cs.String())
+	}
+
+	// a client that doesn't ask for it sends frames as they are
+	plain := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	plain.Compress = false
+	defer plain.Stop()
+	if _, err := plain.RPC("127.0.0.1:30381", api.GetContacts); err != nil {
+		t.Fatal(err.Error())
+	}
+	c := plain.Stats().Clients["127.0.0.1:30381"]
+	if c.CompressIn != 0 || server.Stats().Sessions[c.ID].CompressIn != 0 {
+		t.Fatal("frames compressed in a session that didn't ask")
+	}
+
+	// and a server without it refuses to compress, so neither end does
+	off := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	off.Compress = false
+	if err := off.Start("127.0.0.1:30387", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer off.Stop()
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30387", api.ID, name); err != nil {
+		t.Fatal(err.Error())
+	}
+	c = client.Stats().Clients["127.0.0.1:30387"]
+	if c.CompressIn != 0 || off.Stats().Sessions[c.ID].CompressIn != 0 {
+		t.Fatal("frames compressed by a server without Compress set")
+	}
+}
+
+func Test_Compress_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30398", true); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// the server starts compressing, but the client doesn't hear about it until it asks again
+	proxy := probeLosingProxy(t, "127.0.0.1:30399", "127.0.0.1:30398", 'z', 2)
+	defer proxy.Shutdown()
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Alphabets = []string{"base32"}
+	client.RPCTimeout = 30 * time.Second
+	defer client.Stop()
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	name := strings.Repeat("compressible ", 300)
+	if _, err := client.RPC("127.0.0.1:30399", api.AddContact, name, key.GetPubKey().ToB64()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if cs := client.Stats(); cs.CompressionRatio() < 2 {
+		t.Fatal("frames not compressed: ", cs.CompressionRatio())
+	}
+}
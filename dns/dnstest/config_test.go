@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Config_1(t *testing.T) {
+
+	certPem, keyPem, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pin, err := dns.CertPin(certPem)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// every tunable away from its default
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	m := dns.New(node, 0xDEADBEEF, 0x12345678)
+	m.ListenStr = "127.0.0.1:5353"
+	m.UpstreamStr = "tls://192.0.2.1:853"
+	m.RecordType = "AAAA"
+	m.Domain = "t.example.org."
+	m.RPCTimeout = 90 * time.Second
+	m.EDNSSize = 4096
+	m.DoHMethod = "GET"
+	m.TLSListenStr = ":853"
+	m.Cert, m.Key = certPem, keyPem
+	m.TLSPins = []string{pin}
+	m.Alphabets = []string{"base36", "base32hex"}
+	m.ProbeMTU = false
+	m.PollInterval = 50 * time.Millisecond
+	m.PollMaxInterval = 5 * time.Second
+	m.PollJitter = 0.5
+	m.MaxQPS = 12.5
+	m.StatsInterval = 10 * time.Second
+	m.Encrypt = false
+	m.ServerKey = pubkeyb64Ecc
+	sessionKey := new(ecc.KeyPair)
+	if err := sessionKey.FromB64(pubprivkeyb64Ecc); err != nil {
+		t.Fatal(err.Error())
+	}
+	m.SessionKey = sessionKey
+	m.TSIGKeyName = "tunnel.example.org."
+	m.TSIGSecret = "c2VjcmV0"
+	m.DataShards, m.ParityShards = 4, 2
+	m.SourceQPS = 1000
+	m.MaxSources = 50
+	m.SessionQPS = 20
+	m.MaxHeldQueries = 10
+	m.MaxQuerySize = 512
+	m.LimitAction = dns.LimitDrop
+	m.Resolvers = []string{"127.0.0.1:53", "https://dns.example.org/dns-query"}
+	m.ResolverPolicy = dns.PolicyWeighted
+	m.ResolverFailures = 5
+	m.ResolverRetry = 10 * time.Second
+	m.HoldTimeout = 2 * time.Second
+	m.Polls = 5
+	m.MaxInFlight = 4
+	m.Compress = false
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// through the ratnet registry, as a node's importer does it
+	restored, ok := ratnet.NewTransportFromMap(node, config).(*dns.Module)
+	if !ok {
+		t.Fatal("dns transport not restored as a *dns.Module")
+	}
+	exported := func(m *dns.Module) map[string]interface{} {
+		fields := make(map[string]interface{})
+		v := reflect.ValueOf(m).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.PkgPath == "" && f.Name != "HTTPClient" {
+				fields[f.Name] = v.Field(i).Interface()
+			}
+		}
+		return fields
+	}
+	want, got := exported(m), exported(restored)
+	for name := range want {
+		if !reflect.DeepEqual(want[name], got[name]) {
+			t.Errorf("%s not restored, want %v, got %v", name, want[name], got[name])
+		}
+	}
+
+	// and it writes out the same again
+	b2, err := json.Marshal(restored)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(b) != string(b2) {
+		t.Fatal("config changed on a round trip:\n", string(b), "\n", string(b2))
+	}
+}
+
+func Test_Config_2(t *testing.T) {
+
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	bad := map[string]interface{}{
+		"Transport":      "dns",
+		"UpstreamStr":    "127.0.0.1:53",
+		"ClientConv":     float64(-1),
+		"ServerConv":     "0x11111111",
+		"RecordType":     "SRV",
+		"RPCTimeout":     "soon",
+		"EDNSSize":       float64(100),
+		"DoHMethod":      "PUT",
+		"Alphabets":      []interface{}{"base32", "rot13"},
+		"TLSPins":        []interface{}{42},
+		"PollJitter":     float64(2),
+		"MaxQPS":         float64(-5),
+		"ProbeMTU":       "yes",
+		"PollInterval":   float64(20),
+		"TSIGSecret":     "not base64!",
+		"DataShards":     float64(0),
+		"LimitAction":    "ignore",
+		"ResolverPolicy": "random",
+		"Polls":          float64(0),
+		"MaxInFlight":    float64(-1),
+		"Compress":       "yes",
+	}
+
+	if _, err := dns.NewFromConfig(node, bad); err == nil {
+		t.Fatal("NewFromConfig accepted a bad config")
+	} else {
+		for key := range bad {
+			if key == "Transport" || key == "UpstreamStr" {
+				continue
+			}
+			if !strings.Contains(err.Error(), key+":") {
+				t.Error("error does not mention "+key+": ", err)
+			}
+		}
+	}
+
+	// NewFromMap doesn't panic, and keeps the good values and the defaults for the bad ones
+	m := dns.NewFromMap(node, bad).(*dns.Module)
+	def := dns.New(node, 0xFFFFFFFF, 0xFFFFFFFF)
+	if m.UpstreamStr != "127.0.0.1:53" {
+		t.Error("good value lost: ", m.UpstreamStr)
+	}
+	if m.ClientConv != def.ClientConv || m.ServerConv != def.ServerConv || m.RecordType != def.RecordType ||
+		m.RPCTimeout != def.RPCTimeout || m.EDNSSize != def.EDNSSize || m.DoHMethod != def.DoHMethod ||
+		!reflect.DeepEqual(m.Alphabets, def.Alphabets) || m.TLSPins != nil || m.PollJitter != def.PollJitter ||
+		m.MaxQPS != def.MaxQPS || m.ProbeMTU != def.ProbeMTU || m.PollInterval != def.PollInterval || m.TSIGSecret != def.TSIGSecret ||
+		m.DataShards != def.DataShards || m.LimitAction != def.LimitAction || m.ResolverPolicy != def.ResolverPolicy || m.Polls != def.Polls ||
+		m.MaxInFlight != def.MaxInFlight || m.Compress != def.Compress {
+		t.Error("bad values not left at their defaults")
+	}
+
+	// conv IDs from JSON are float64, and whole numbers in range are fine
+	m, err := dns.NewFromConfig(node, map[string]interface{}{"ClientConv": float64(0xFFFFFFFE), "ServerConv": float64(0)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.ClientConv != 0xFFFFFFFE || m.ServerConv != 0 {
+		t.Fatal("conv IDs not read from float64")
+	}
+	if _, err := dns.NewFromConfig(node, map[string]interface{}{"ClientConv": 1.5}); err == nil {
+		t.Fatal("fractional conv ID accepted")
+	}
+}
+
+func Test_Config_3(t *testing.T) {
+
+	// a new module has its session key from the start, so a server restarted from its config keeps it
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	m := dns.New(node, 0xFFFFFFFF, 0xFFFFFFFF)
+	if m.SessionKey == nil {
+		t.Fatal("New made no SessionKey")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err.Error())
+	}
+	restarted, err := dns.NewFromConfig(node, cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if restarted.SessionKey.GetPubKey().ToB64() != m.SessionKey.GetPubKey().ToB64() {
+		t.Fatal("SessionKey changed when restarted from the config")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/awgh/ratnet-transports/dns"
+
+	mdns "github.com/miekg/dns"
+)
+
+func Test_Conn_1(t *testing.T) {
+
+	l, err := dns.Listen("127.0.0.1:30374", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// the server echoes everything back, and closes when the client does
+	echoed := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			echoed <- err
+			return
+		}
+		_, err = io.Copy(conn, conn)
+		conn.Close()
+		echoed <- err
+	}()
+
+	conn, err := dns.Dial("127.0.0.1:30374", map[string]interface{}{"PollMaxInterval": "200ms"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// an idle read gives up at its deadline
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("read past its deadline did not time out: ", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// many kcp segments, both ways
+	data := make([]byte, 2000)
+	rand.Read(data)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("stream data changed on the way through")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case err := <-echoed:
+		if err != nil {
+			t.Fatal("server stream did not end cleanly: ", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("server stream did not see the client close")
+	}
+
+	// a closed stream can't be used
+	if _, err := conn.Write(data); err != dns.ErrClosed {
+		t.Fatal("write after close: ", err)
+	}
+}
+
+func Test_Conn_2(t *testing.T) {
+
+	l, err := dns.Listen("127.0.0.1:30384", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// the server says goodbye and closes first
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+
+	conn, err := dns.Dial("127.0.0.1:30384", map[string]interface{}{"PollMaxInterval": "200ms"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "bye" {
+		t.Fatal("read ", string(got), " before the server closed")
+	}
+
+	// and forgets the session, so the client's stream ends too
+	deadline := time.Now().Add(20 * time.Second)
+	conn.SetWriteDeadline(deadline)
+	for {
+		if _, err := conn.Write([]byte("hello?")); errors.Is(err, dns.ErrSessionLost) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server kept the session of a stream it closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// mtuProbe - sends a raw probe setting the downstream mtu of a session, as anyone can before the handshake
+func mtuProbe(addr string) error {
+	data := make([]byte, 11)
+	data[0] = 'm'
+	binary.BigEndian.PutUint16(data[1:], 150)
+	rand.Read(data[3:])
+	session := make([]byte, 7)
+	rand.Read(session)
+	for i, b := range session {
+		session[i] = "abcdefghijklmnopqrstuvwxyz234567"[b%32]
+	}
+	codec, err := dns.NameCodecByName("base32")
+	if err != nil {
+		return err
+	}
+	name, err := dns.DotifyCodec(data, "n"+string(codec.ID())+string(session)+".", codec)
+	if err != nil {
+		return err
+	}
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	_, _, err = (&mdns.Client{Net: "udp", Timeout: 2 * time.Second}).Exchange(req, addr)
+	return err
+}
+
+func Test_Conn_3(t *testing.T) {
+
+	l, err := dns.Listen("127.0.0.1:30400", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// probes for sessions that never finish a handshake are not streams
+	for i := 0; i < 250; i++ {
+		if err := mtuProbe("127.0.0.1:30400"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	conn, err := dns.Dial("127.0.0.1:30400", map[string]interface{}{"PollMaxInterval": "200ms"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer accepted.Close()
+	if accepted.RemoteAddr().(*dns.Addr).Session != conn.LocalAddr().(*dns.Addr).Session {
+		t.Fatal("accepted a stream nobody dialed: ", accepted.RemoteAddr())
+	}
+
+	// and the one dialed works
+	if _, err := accepted.Write([]byte("hi")); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := make([]byte, 2)
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "hi" {
+		t.Fatal("stream data changed on the way through: ", string(got))
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_DoH_1(t *testing.T) {
+
+	serverKey, routingKey := new(ecc.KeyPair), new(ecc.KeyPair)
+	serverKey.GenerateKey()
+	routingKey.GenerateKey()
+	node := ram.New(serverKey, routingKey)
+	server := dns.New(node, 0x11111111, 0x22222222)
+	defer server.Stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", server.DoHHandler())
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.HTTPClient = ts.Client()
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		client.DoHMethod = method
+		v, err := client.RPC(ts.URL+"/dns-query", api.ID)
+		if err != nil {
+			t.Fatal(method, err.Error())
+		}
+		id, err := node.ID()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if key, ok := v.(*ecc.PubKey); !ok || key.ToB64() != id.ToB64() {
+			t.Fatalf("%s: DoH RPC returned the wrong ID: %+v", method, v)
+		}
+	}
+
+	// a stopped server turns DoH requests away, its sessions are gone
+	server.Stop()
+	resp, err := ts.Client().Post(ts.URL+"/dns-query", "application/dns-message", bytes.NewReader([]byte{0}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("stopped server answered DoH with ", resp.Status)
+	}
+}
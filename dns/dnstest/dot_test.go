@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_DoT_1(t *testing.T) {
+
+	certPem, keyPem, err := bc.GenerateSSLCertBytes(true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pin, err := dns.CertPin(certPem)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	serverKey, routingKey := new(ecc.KeyPair), new(ecc.KeyPair)
+	serverKey.GenerateKey()
+	routingKey.GenerateKey()
+	node := ram.New(serverKey, routingKey)
+	server := dns.New(node, 0x11111111, 0x22222222)
+	server.Cert, server.Key = certPem, keyPem
+	server.TLSListenStr = "127.0.0.1:30853"
+	server.Listen("127.0.0.1:30353", false)
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	// DoT picked per peer by config alone
+	client := dns.NewFromMap(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), map[string]interface{}{
+		"Transport":   "dns",
+		"UpstreamStr": "tls://127.0.0.1:30853",
+		"ClientConv":  uint32(0x22222222),
+		"ServerConv":  uint32(0x11111111),
+		"TLSPins":     []interface{}{pin},
+	}).(*dns.Module)
+	v, err := client.RPC("", api.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	id, err := node.ID()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if key, ok := v.(*ecc.PubKey); !ok || key.ToB64() != id.ToB64() {
+		t.Fatalf("DoT RPC returned the wrong ID: %+v", v)
+	}
+
+	// a certificate that doesn't match the pin gets nothing
+	client.TLSPins = []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+	client.RPCTimeout = 3 * time.Second
+	if _, err := client.RPC("tls://127.0.0.1:30853", api.ID); err == nil {
+		t.Fatal("DoT RPC succeeded with the wrong pin")
+	}
+}
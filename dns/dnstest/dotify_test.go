@@ -6,6 +6,8 @@ import (
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/ratnet-transports/dns"
+
+	mdns "github.com/miekg/dns"
 )
 
 func Test_Dotify_Undotify_1(t *testing.T) {
@@ -49,3 +51,105 @@ func Test_Dotify_Undotify_2(t *testing.T) {
 		t.Error("Equality check failed: ", badbytes, len(badbytes), undot, len(undot))
 	}
 }
+
+func Test_DotifyDomain_1(t *testing.T) {
+
+	domain := "t.example.org."
+	max := dns.MaxDotifyLen(domain)
+	if max < 100 || max >= 150 {
+		t.Fatal("MaxDotifyLen out of range: ", max)
+	}
+	for i := 0; i <= max; i++ {
+		testcase, err := bc.GenerateRandomBytes(i)
+		if err != nil {
+			t.Error(err.Error())
+		}
+
+		dot, err := dns.DotifyDomain(testcase, domain)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(dot) > 253 {
+			t.Fatal("DotifyDomain name too long: ", len(dot))
+		}
+		if _, ok := mdns.IsDomainName(dot); !ok {
+			t.Fatal("DotifyDomain made an invalid name: ", dot)
+		}
+		undot, err := dns.UndotifyDomain(dot, domain)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if !bytes.Equal(testcase, undot) {
+			t.Error("Equality check failed: ", testcase, len(testcase), undot, len(undot))
+		}
+	}
+
+	testcase, _ := bc.GenerateRandomBytes(max + 1)
+	if _, err := dns.DotifyDomain(testcase, domain); err == nil {
+		t.Error("DotifyDomain should not fit more than MaxDotifyLen bytes")
+	}
+	if _, err := dns.UndotifyDomain("MZXW6.example.com.", domain); err != dns.ErrOutOfZone {
+		t.Error("UndotifyDomain accepted a name outside the tunnel domain")
+	}
+}
+
+func Test_DotifyCodec_1(t *testing.T) {
+
+	domain := "t.example.org."
+	for name, codec := range dns.NameCodecs {
+		for i := 0; i < 254; i++ {
+			testcase, err := bc.GenerateRandomBytes(i)
+			if err != nil {
+				t.Error(err.Error())
+			}
+
+			dot, err := dns.DotifyCodec(testcase, domain, codec)
+			if err != nil {
+				if i < 100 {
+					t.Fatal(name, i, err.Error())
+				}
+				break // full
+			}
+
+			// through the wire format, like a resolver would
+			msg := new(mdns.Msg)
+			msg.SetQuestion(dot, mdns.TypeTXT)
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Fatal(name, i, err.Error())
+			}
+			if err := msg.Unpack(packed); err != nil {
+				t.Fatal(name, i, err.Error())
+			}
+			dot = msg.Question[0].Name
+
+			// DNS 0x20, resolvers may randomize the case of a name
+			if name != "binary" {
+				b := []byte(dot)
+				for j := range b {
+					if j%3 == 0 && b[j] >= 'a' && b[j] <= 'z' {
+						b[j] -= 'a' - 'A'
+					} else if j%3 == 1 && b[j] >= 'A' && b[j] <= 'Z' {
+						b[j] += 'a' - 'A'
+					}
+				}
+				dot = string(b)
+			}
+
+			undot, err := dns.UndotifyCodec(dot, domain, codec)
+			if err != nil {
+				t.Fatal(name, i, err.Error())
+			}
+			if !bytes.Equal(testcase, undot) {
+				t.Fatal(name, "Equality check failed: ", testcase, len(testcase), undot, len(undot))
+			}
+		}
+	}
+
+	if _, err := dns.NameCodecByName("base36"); err != nil {
+		t.Error("base36 codec lookup failed")
+	}
+	if _, err := dns.NameCodecByName("rot13"); err == nil {
+		t.Error("rot13 is not a name codec")
+	}
+}
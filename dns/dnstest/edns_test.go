@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// ednsProxy - a resolver on listen that passes queries upstream over network, letting inspect look at or change each answer
+func ednsProxy(t *testing.T, network, listen, upstream string, inspect func(req, r *mdns.Msg)) *mdns.Server {
+	proxy, err := startProxy(network, listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		inspect(req, r)
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_EDNS_1(t *testing.T) {
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	node := ram.New(new(ecc.KeyPair), new(ecc.KeyPair))
+	for i := 0; i < 30; i++ {
+		if err := node.AddContact(fmt.Sprintf("contact %d", i), key.GetPubKey().ToB64()); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	server := dns.New(node, 0x11111111, 0x22222222)
+	server.Listen("127.0.0.1:30391", true)
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	var mutex sync.Mutex
+	largest, truncated, tcpQueries := 0, 0, 0
+
+	// answers bigger than 512 bytes go over UDP to a client that advertises room for them
+	udp := ednsProxy(t, "udp", "127.0.0.1:30392", "127.0.0.1:30391", func(req, r *mdns.Msg) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Len() > largest {
+			largest = r.Len()
+		}
+		if r.Truncated {
+			truncated++
+		}
+	})
+	defer udp.Shutdown()
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30392", api.GetContacts); err != nil {
+		t.Fatal(err.Error())
+	}
+	mutex.Lock()
+	if largest <= mdns.MinMsgSize || largest > int(client.EDNSSize) || truncated != 0 {
+		t.Error("answers not sized to the EDNS0 buffer: ", largest, truncated)
+	}
+	mutex.Unlock()
+
+	// a client falls back to TCP for every answer truncated on the way, probes need theirs over UDP
+	udp = ednsProxy(t, "udp", "127.0.0.1:30393", "127.0.0.1:30391", func(req, r *mdns.Msg) {
+		labels := mdns.SplitDomainName(req.Question[0].Name)
+		if kind := strings.ToLower(labels[len(labels)-1])[0]; kind != 'n' && len(r.Answer) > 0 {
+			r.Answer = nil
+			r.Truncated = true
+		}
+	})
+	defer udp.Shutdown()
+	tcp := ednsProxy(t, "tcp", "127.0.0.1:30393", "127.0.0.1:30391", func(req, r *mdns.Msg) {
+		mutex.Lock()
+		tcpQueries++
+		mutex.Unlock()
+	})
+	defer tcp.Shutdown()
+	value, err := client.RPC("127.0.0.1:30393", api.GetContacts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if contacts, ok := value.([]api.Contact); !ok || len(contacts) != 30 {
+		t.Fatal("contacts lost on the way through: ", value)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if tcpQueries == 0 {
+		t.Fatal("no queries retried over TCP")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet-transports/dns"
+
+	mdns "github.com/miekg/dns"
+)
+
+func Test_RecordEncoders_1(t *testing.T) {
+
+	for rrtype, enc := range dns.RecordEncoders {
+		name := mdns.TypeToString[rrtype]
+		var segments [][]byte
+		for i := 0; i < enc.MaxSegments() && i < 3; i++ {
+			seg, err := bc.GenerateRandomBytes(100 + 25*i)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			segments = append(segments, seg)
+		}
+
+		answers, err := enc.Encode("mail.", segments)
+		if err != nil {
+			t.Fatal(name, err.Error())
+		}
+
+		// round-trip through the wire format, like a resolver would
+		msg := new(mdns.Msg)
+		msg.SetQuestion("mail.", rrtype)
+		msg.Answer = answers
+		msg.Compress = true
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(name, err.Error())
+		}
+		size := 0
+		for _, seg := range segments {
+			size += enc.Size(len(seg))
+		}
+		if len(packed)-22 > size { // 12 byte header, 10 byte question
+			t.Error(name, "Size underestimated the answer length:", size, len(packed))
+		}
+		unpacked := new(mdns.Msg)
+		if err := unpacked.Unpack(packed); err != nil {
+			t.Fatal(name, err.Error())
+		}
+
+		// resolvers may shuffle the records in an RRset
+		rrs := unpacked.Answer
+		for i, j := 0, len(rrs)-1; i < j; i, j = i+1, j-1 {
+			rrs[i], rrs[j] = rrs[j], rrs[i]
+		}
+
+		decoded, err := enc.Decode(rrs)
+		if err != nil {
+			t.Fatal(name, err.Error())
+		}
+		if len(decoded) != len(segments) {
+			t.Fatal(name, "Wrong number of segments decoded: ", len(decoded), len(segments))
+		}
+		for _, seg := range segments {
+			found := false
+			for _, d := range decoded {
+				if bytes.Equal(seg, d) {
+					found = true
+				}
+			}
+			if !found {
+				t.Error(name, "Equality check failed: ", seg, len(seg))
+			}
+		}
+	}
+}
+
+func Test_RecordEncoderByName_1(t *testing.T) {
+
+	if enc, err := dns.RecordEncoderByName("null"); err != nil || enc.Type() != mdns.TypeNULL {
+		t.Error("NULL encoder lookup failed")
+	}
+	if _, err := dns.RecordEncoderByName("SOA"); err == nil {
+		t.Error("SOA should not have an encoder")
+	}
+	if _, err := dns.RecordEncoderByName("FNORD"); err == nil {
+		t.Error("FNORD is not a record type")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// a resolver that loses tunnel data both ways, but answers quickly so the test doesn't wait on timeouts:
+// every 4th data query is answered with SERVFAIL instead of being passed on,
+// and every 3rd answer with data in it loses its first record
+func lossyProxy(t *testing.T, listen, upstream string) *mdns.Server {
+	var mutex sync.Mutex
+	queries, answers := 0, 0
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		labels := mdns.SplitDomainName(req.Question[0].Name)
+		kind := strings.ToLower(labels[len(labels)-1])[0]
+		mutex.Lock()
+		if kind == 'd' {
+			queries++
+		}
+		drop := kind == 'd' && queries%4 == 0
+		mutex.Unlock()
+		if drop {
+			r := new(mdns.Msg)
+			r.SetRcode(req, mdns.RcodeServerFailure)
+			return r
+		}
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		if kind != 'n' && len(r.Answer) > 0 {
+			mutex.Lock()
+			answers++
+			if answers%3 == 0 {
+				r.Answer = r.Answer[1:]
+			}
+			mutex.Unlock()
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_FEC_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30368", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+	proxy := lossyProxy(t, "127.0.0.1:30369", "127.0.0.1:30368")
+	defer proxy.Shutdown()
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.DataShards, client.ParityShards = 4, 2
+	client.Compress = false // the calls would compress to a segment or two, and might all get through
+	client.RPCTimeout = 90 * time.Second
+	defer client.Stop()
+	for i := 0; i < 2; i++ {
+		if _, err := client.RPC("127.0.0.1:30369", api.ID, strings.Repeat("x", 1000)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// lost segments were rebuilt at both ends, not just resent
+	cs, ss := client.Stats(), server.Stats()
+	t.Log(cs)
+	t.Log(ss)
+	if ss.Recovered == 0 {
+		t.Fatal("server rebuilt no upstream segments")
+	}
+	if cs.Recovered == 0 {
+		t.Fatal("client rebuilt no downstream segments")
+	}
+	if cs.DecodeFailures != 0 || ss.DecodeFailures != 0 {
+		t.Fatal("FEC shards failed to decode: ", cs.DecodeFailures, ss.DecodeFailures)
+	}
+}
+
+// probeOp - the operation of the probe in a query name spelled in base32, or 0 if it isn't a probe
+func probeOp(name string) byte {
+	labels := mdns.SplitDomainName(name)
+	if len(labels) < 2 || strings.ToLower(labels[len(labels)-1])[0] != 'n' {
+		return 0
+	}
+	codec, err := dns.NameCodecByName("base32")
+	if err != nil {
+		return 0
+	}
+	data, err := dns.UndotifyCodec(strings.Join(labels[:len(labels)-1], "."), "", codec)
+	if err != nil || len(data) == 0 {
+		return 0
+	}
+	return data[0]
+}
+
+// a resolver that loses the answers to the first n probes of operation op
+func probeLosingProxy(t *testing.T, listen, upstream string, op byte, n int) *mdns.Server {
+	var mutex sync.Mutex
+	lost := 0
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if probeOp(req.Question[0].Name) == op && lost < n {
+			lost++
+			return nil
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_FEC_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30396", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// the server turns FEC on, but the client doesn't hear about it until it asks again
+	proxy := probeLosingProxy(t, "127.0.0.1:30397", "127.0.0.1:30396", 'f', 2)
+	defer proxy.Shutdown()
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Alphabets = []string{"base32"}
+	client.DataShards, client.ParityShards = 4, 2
+	client.RPCTimeout = 30 * time.Second
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30397", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ss := server.Stats(); ss.DecodeFailures != 0 {
+		t.Fatal("the client and server disagree on FEC: ", ss.DecodeFailures)
+	}
+}
+
+func Test_FEC_3(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30402", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// the call goes in one kcp packet, the last of a short exchange, and the resolver loses it
+	var mutex sync.Mutex
+	dropped := false
+	proxy, err := startProxy("udp", "127.0.0.1:30403", "127.0.0.1:30402", func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		labels := mdns.SplitDomainName(req.Question[0].Name)
+		mutex.Lock()
+		drop := !dropped && strings.ToLower(labels[len(labels)-1])[0] == 'd'
+		dropped = dropped || drop
+		mutex.Unlock()
+		if drop {
+			r := new(mdns.Msg)
+			r.SetRcode(req, mdns.RcodeServerFailure)
+			return r
+		}
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer proxy.Shutdown()
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.ParityShards = 2
+	client.RPCTimeout = 30 * time.Second
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30403", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the parity of its unfinished group rebuilt it, instead of waiting for kcp to send it again
+	if ss := server.Stats(); ss.Recovered == 0 || ss.DecodeFailures != 0 {
+		t.Fatal("server rebuilt no segment from a short group: ", ss.Recovered, ss.DecodeFailures)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Framing_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30380", true); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	pub := key.GetPubKey().ToB64()
+
+	// a call several kcp messages long, and then a response as long
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Compress = false // the name would compress to fit in one message
+	defer client.Stop()
+	name := strings.Repeat("a long contact name ", 400)
+	if _, err := client.RPC("127.0.0.1:30380", api.AddContact, name, pub); err != nil {
+		t.Fatal(err.Error())
+	}
+	// and small ones after it, still framed right
+	if _, err := client.RPC("127.0.0.1:30380", api.AddContact, "short", pub); err != nil {
+		t.Fatal(err.Error())
+	}
+	value, err := client.RPC("127.0.0.1:30380", api.GetContacts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	contacts, ok := value.([]api.Contact)
+	if !ok {
+		t.Fatalf("GetContacts returned %T", value)
+	}
+	found := 0
+	for _, c := range contacts {
+		if (c.Name == name || c.Name == "short") && c.Pubkey == pub {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatal("contacts lost or changed on the way through: ", len(contacts))
+	}
+	if failures := server.Stats().DecodeFailures + client.Stats().DecodeFailures; failures != 0 {
+		t.Fatal("frames failed to decode: ", failures)
+	}
+}
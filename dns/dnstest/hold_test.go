@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/nodes/ram"
+	kcp "github.com/xtaci/kcp-go"
+
+	mdns "github.com/miekg/dns"
+)
+
+// heldAnswer - a response to a query held by the server, and how long it took
+type heldAnswer struct {
+	answers int
+	took    time.Duration
+}
+
+// sendHeld - sends a query for name to the server at 30375, and records what came back at i
+func sendHeld(wg *sync.WaitGroup, results []heldAnswer, i int, name string) {
+	defer wg.Done()
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	client := &mdns.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	r, _, err := client.Exchange(req, "127.0.0.1:30375")
+	results[i] = heldAnswer{answers: -1, took: time.Since(start)}
+	if err == nil {
+		results[i].answers = len(r.Answer)
+	}
+}
+
+// openSession - starts session, spelled as in a header label, on the server at addr with a probe, as a client does
+func openSession(addr string, codec dns.NameCodec, session string) error {
+	name, err := dns.DotifyCodec([]byte("o\x00\x00opened!"), "n"+string(codec.ID())+session+".", codec)
+	if err != nil {
+		return err
+	}
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	_, _, err = (&mdns.Client{Timeout: 2 * time.Second}).Exchange(req, addr)
+	return err
+}
+
+func Test_Hold_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.Encrypt = false
+	server.HoldTimeout = 2 * time.Second
+	if err := server.Start("127.0.0.1:30375", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	codec, err := dns.NameCodecByName("base32")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, 0x5e55104)
+	session := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id))
+	poll := func(nonce string) string { return nonce + ".p" + string(codec.ID()) + session + "." }
+	if err := openSession("127.0.0.1:30375", codec, session); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a kcp segment from the client, the server acknowledges it
+	var segment []byte
+	k := kcp.NewKCP(0x22222222, func(buf []byte, size int) { segment = append([]byte{}, buf[:size]...) })
+	k.Send([]byte("hello"))
+	for segment == nil {
+		k.Update()
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := dns.DotifyCodec(segment, "d"+string(codec.ID())+session+".", codec)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// two polls are held, then the acknowledgement goes to the oldest, and the newer one waits it out
+	var wg sync.WaitGroup
+	results := make([]heldAnswer, 3)
+	for i, name := range []string{poll("aaaaaaaa"), poll("bbbbbbbb"), data} {
+		wg.Add(1)
+		go sendHeld(&wg, results, i, name)
+		time.Sleep(200 * time.Millisecond)
+	}
+	wg.Wait()
+	if oldest := results[0]; oldest.answers != 1 || oldest.took > 1500*time.Millisecond {
+		t.Fatal("oldest held poll not answered with the data: ", oldest)
+	}
+	if newer := results[1]; newer.answers != 0 || newer.took < server.HoldTimeout-200*time.Millisecond {
+		t.Fatal("newer held poll not held until HoldTimeout: ", newer)
+	}
+
+	// too many held for one session, the oldest is answered empty to make room
+	results = make([]heldAnswer, 17)
+	wg.Add(1)
+	go sendHeld(&wg, results, 0, poll("cccccccc"))
+	time.Sleep(200 * time.Millisecond)
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go sendHeld(&wg, results, i, poll(strings.Repeat(string(rune('d'+i)), 8)))
+	}
+	wg.Wait()
+	if oldest := results[0]; oldest.answers != 0 || oldest.took > 1500*time.Millisecond {
+		t.Fatal("oldest held poll not released: ", oldest)
+	}
+}
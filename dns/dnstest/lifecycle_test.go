@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Lifecycle_1(t *testing.T) {
+
+	// no upstream is an error, not a crash
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	if _, err := client.RPC("", api.ID); err != dns.ErrNoUpstream {
+		t.Fatal("RPC without an upstream returned the wrong error: ", err)
+	}
+
+	// a port that's taken is an error, not a crash
+	taken, err := net.ListenPacket("udp", "127.0.0.1:30354")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30354", false); err == nil {
+		t.Fatal("Start on a port in use did not fail")
+	}
+	taken.Close()
+
+	// restart on the same module and port
+	for i := 0; i < 2; i++ {
+		if err := server.Start("127.0.0.1:30354", false); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := server.Start("127.0.0.1:30354", false); err == nil {
+			t.Fatal("Start on a running server did not fail")
+		}
+		if _, err := client.RPC("127.0.0.1:30354", api.ID); err != nil {
+			t.Fatal(err.Error())
+		}
+		server.Stop()
+		client.Stop()
+		if client.IsRunningClient() || server.IsRunningServer() {
+			t.Fatal("Stop left the module running")
+		}
+	}
+
+	// Stop releases RPCs still waiting on a response
+	done := make(chan error)
+	go func() {
+		_, err := client.RPC("127.0.0.1:30999", api.ID)
+		done <- err
+	}()
+	time.Sleep(500 * time.Millisecond)
+	client.Stop()
+	select {
+	case err := <-done:
+		if err != dns.ErrStopped {
+			t.Fatal("Stop returned the wrong error to a waiting RPC: ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop did not release a waiting RPC")
+	}
+}
+
+func Test_Lifecycle_2(t *testing.T) {
+
+	// a server that restarts forgets every session, a client that keeps going starts a new one
+	for _, encrypt := range []bool{false, true} {
+		server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+		server.Encrypt = encrypt
+		if err := server.Start("127.0.0.1:30382", false); err != nil {
+			t.Fatal(err.Error())
+		}
+		client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+		client.Encrypt = encrypt
+		client.RPCTimeout = 20 * time.Second
+		if _, err := client.RPC("127.0.0.1:30382", api.ID); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		server.Stop()
+		if err := server.Start("127.0.0.1:30382", false); err != nil {
+			t.Fatal(err.Error())
+		}
+		start := time.Now()
+		if _, err := client.RPC("127.0.0.1:30382", api.ID); err != nil {
+			t.Fatal("RPC after a server restart, encrypt ", encrypt, ": ", err)
+		}
+		if d := time.Since(start); d > 10*time.Second {
+			t.Error("RPC after a server restart took too long, encrypt ", encrypt, ": ", d)
+		}
+		client.Stop()
+		server.Stop()
+	}
+}
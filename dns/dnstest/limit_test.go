@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// rcode - sends a query for name and returns the response code, or -1 if there was no answer
+func rcode(name string) int {
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	client := &mdns.Client{Timeout: 500 * time.Millisecond}
+	r, _, err := client.Exchange(req, "127.0.0.1:30370")
+	if err != nil {
+		return -1
+	}
+	return r.Rcode
+}
+
+// rcodeFrom - like rcode, but sends the query to server from the address local
+func rcodeFrom(local, server, name string) int {
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	client := &mdns.Client{Timeout: 500 * time.Millisecond, Dialer: &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(local)}}}
+	r, _, err := client.Exchange(req, server)
+	if err != nil {
+		return -1
+	}
+	return r.Rcode
+}
+
+func Test_Limits_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.SourceQPS = 5
+	server.MaxQuerySize = 200
+	server.MaxHeldQueries = 1
+	server.Encrypt = false // so raw polls are answered
+	if err := server.Start("127.0.0.1:30370", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// a query too big is refused
+	long := strings.Repeat(strings.Repeat("a", 60)+".", 4)
+	if rc := rcode(long); rc != mdns.RcodeRefused {
+		t.Fatal("oversized query not refused: ", rc)
+	}
+
+	// one address gets a second's worth of queries, then is refused
+	refused := 0
+	for i := 0; i < 20; i++ {
+		if rcode("example.com.") == mdns.RcodeRefused {
+			refused++
+		}
+	}
+	if refused < 10 {
+		t.Fatal("queries over SourceQPS not refused: ", refused)
+	}
+	time.Sleep(time.Second)
+
+	// past MaxHeldQueries, a poll is answered at once instead of held
+	codec, err := dns.NameCodecByName("base32")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := openSession("127.0.0.1:30370", codec, "aaaaaaa"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rcode("aaaaaaaa.pbaaaaaaa.") // held until serverTimeout, there's nothing to send
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if rc := rcode("bbbbbbbb.pbaaaaaaa."); rc != mdns.RcodeSuccess {
+		t.Fatal("poll over MaxHeldQueries not answered: ", rc)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("poll over MaxHeldQueries was held: ", d)
+	}
+	wg.Wait()
+
+	// with LimitAction drop, nothing comes back
+	server.LimitAction = dns.LimitDrop
+	if rc := rcode(long); rc != -1 {
+		t.Fatal("oversized query answered: ", rc)
+	}
+
+	if limited := server.Stats().Limited; limited < 12 {
+		t.Fatal("limit hits not counted: ", limited)
+	}
+}
+
+func Test_Limits_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.MaxSources = 2
+	if err := server.Start("127.0.0.1:30407", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// two busy addresses fill the table, a third is refused until one goes quiet
+	for _, local := range []string{"127.0.0.2", "127.0.0.3"} {
+		if rc := rcodeFrom(local, "127.0.0.1:30407", "example.com."); rc == mdns.RcodeRefused || rc == -1 {
+			t.Fatal("query from ", local, " not answered: ", rc)
+		}
+	}
+	if rc := rcodeFrom("127.0.0.4", "127.0.0.1:30407", "example.com."); rc != mdns.RcodeRefused {
+		t.Fatal("query from a source past MaxSources not refused: ", rc)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if rc := rcodeFrom("127.0.0.4", "127.0.0.1:30407", "example.com."); rc == mdns.RcodeRefused || rc == -1 {
+		t.Fatal("query from a new source not answered once the others went quiet: ", rc)
+	}
+}
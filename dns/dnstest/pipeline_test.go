@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+// callMany - makes n ID RPCs to host at once, failing the test if any fail
+func callMany(t *testing.T, client *dns.Module, host string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.RPC(host, api.ID); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_Pipeline_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.TSIGSecret = tsigSecret
+	if err := server.Start("127.0.0.1:30376", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// signed answers are matched to their queries while many are in flight, and the window opens up
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.TSIGSecret = tsigSecret
+	client.MaxInFlight = 8
+	callMany(t, client, "127.0.0.1:30376", 40)
+	if window := client.Stats().Clients["127.0.0.1:30376"].Window; window <= 2 || window > client.MaxInFlight {
+		t.Error("window did not open up without loss: ", window)
+	}
+	client.Stop()
+	if rejected := client.Stats().Rejected; rejected != 0 {
+		t.Fatal("pipelined answers failed TSIG: ", rejected)
+	}
+
+	// through a resolver that loses every 4th data query, the window stays small and the RPCs still get through
+	// the proxy can't pass on signed answers it has cut short, so this server doesn't sign
+	lossy := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := lossy.Start("127.0.0.1:30377", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lossy.Stop()
+	proxy := lossyProxy(t, "127.0.0.1:30379", "127.0.0.1:30377")
+	defer proxy.Shutdown()
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.MaxInFlight = 8
+	callMany(t, client, "127.0.0.1:30379", 40)
+	if window := client.Stats().Clients["127.0.0.1:30379"].Window; window < 1 || window > 4 {
+		t.Error("window did not close down under loss: ", window)
+	}
+	client.Stop()
+}
+
+func Test_Pipeline_2(t *testing.T) {
+
+	l, err := dns.Listen("127.0.0.1:30378", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	// a stream many times the kcp window, pipelined it goes through in a few round trips each way
+	conn, err := dns.Dial("127.0.0.1:30378", map[string]interface{}{"MaxInFlight": float64(16)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	data := make([]byte, 20000)
+	rand.Read(data)
+	start := time.Now()
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("stream data changed on the way through")
+	}
+	t.Log("echoed ", len(data), " bytes in ", time.Since(start))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// a resolver that caches every answer by name, like one that ignores a TTL of zero
+// hits counts the queries answered from the cache
+func cachingProxy(t *testing.T, listen, upstream string, hits *int) *mdns.Server {
+	var mutex sync.Mutex
+	cache := make(map[string]*mdns.Msg)
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		key := strings.ToLower(req.Question[0].Name)
+		mutex.Lock()
+		r, ok := cache[key]
+		if ok {
+			*hits++
+		}
+		mutex.Unlock()
+		if !ok {
+			var err error
+			if r, err = exchange(req); err != nil {
+				return nil
+			}
+			mutex.Lock()
+			cache[key] = r
+			mutex.Unlock()
+		}
+		r = r.Copy()
+		r.Id = req.Id
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_Poll_Cache_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.Domain = "t.example.org."
+	if err := server.Start("127.0.0.1:30358", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+	hits := 0
+	proxy := cachingProxy(t, "127.0.0.1:30359", "127.0.0.1:30358", &hits)
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Domain = "t.example.org."
+	client.RPCTimeout = 30 * time.Second
+	for i := 0; i < 3; i++ {
+		if _, err := client.RPC("127.0.0.1:30359", api.ID, strings.Repeat("x", 1000)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	client.Stop()
+	proxy.Shutdown()
+
+	// every query has to get through to the server
+	if hits > 0 {
+		t.Fatal("Queries were answered from the cache: ", hits)
+	}
+}
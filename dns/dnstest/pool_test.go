@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+func Test_Pool_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30371", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// one resolver of two is dead, the link still works and the dead one is taken out of the pool
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Resolvers = []string{"127.0.0.1:30372", "127.0.0.1:30371"}
+	client.ResolverFailures = 2
+	client.ResolverRetry = 200 * time.Millisecond
+	defer client.Stop()
+	if _, err := client.RPC("", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats := client.Stats().Resolvers
+	if dead := stats["127.0.0.1:30372"]; dead.Up || dead.Failures < 2 {
+		t.Fatal("dead resolver not taken out of the pool: ", dead)
+	}
+	if live := stats["127.0.0.1:30371"]; !live.Up || live.Queries == 0 {
+		t.Fatal("live resolver not used: ", live)
+	}
+
+	// when it comes back, it is found by a retry and used again
+	proxy, recorded := recordingProxy(t, "127.0.0.1:30372", "127.0.0.1:30371")
+	defer proxy.Shutdown()
+	client.ResolverPolicy = dns.PolicyWeighted
+	for i := 0; i < 20 && !client.Stats().Resolvers["127.0.0.1:30372"].Up; i++ {
+		if _, err := client.RPC("", api.ID); err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if back := client.Stats().Resolvers["127.0.0.1:30372"]; !back.Up {
+		t.Fatal("resolver not back in the pool: ", back)
+	}
+	if _, err := client.RPC("", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(recorded()) == 0 {
+		t.Fatal("no queries through the resolver that came back")
+	}
+	t.Log(client.Stats())
+}
+
+func Test_Pool_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30405", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// one resolver fails every query it gets, but is never taken out of the pool
+	var mutex sync.Mutex
+	failed := make(map[string]bool)
+	broken, err := startProxy("udp", "127.0.0.1:30404", "127.0.0.1:30405", func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		mutex.Lock()
+		failed[req.Question[0].Name] = true
+		mutex.Unlock()
+		r := new(mdns.Msg)
+		r.SetRcode(req, mdns.RcodeServerFailure)
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer broken.Shutdown()
+	live, recorded := recordingProxy(t, "127.0.0.1:30406", "127.0.0.1:30405")
+	defer live.Shutdown()
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.Resolvers = []string{"127.0.0.1:30404", "127.0.0.1:30406"}
+	client.ResolverFailures = 1000
+	client.RPCTimeout = 30 * time.Second
+	defer client.Stop()
+	if _, err := client.RPC("", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the queries it failed were sent again to the other
+	resent := 0
+	for _, msg := range recorded() {
+		mutex.Lock()
+		if failed[msg.Question[0].Name] {
+			resent++
+		}
+		mutex.Unlock()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(failed) == 0 || resent == 0 {
+		t.Fatal("no unanswered queries sent to the next resolver: ", len(failed), resent)
+	}
+	t.Log(len(failed), resent)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// sizeProbe - sends a raw probe asking for an n byte answer over network, advertising an EDNS0 buffer of
+// udpSize, or none if zero, and with the query padded out to the size of the answer if pad is set
+func sizeProbe(network, addr string, n int, udpSize uint16, pad bool) (*mdns.Msg, error) {
+	data := make([]byte, 11)
+	data[0] = 's'
+	binary.BigEndian.PutUint16(data[1:], uint16(n))
+	rand.Read(data[3:])
+	codec, err := dns.NameCodecByName("base32")
+	if err != nil {
+		return nil, err
+	}
+	name, err := dns.DotifyCodec(data, "n"+string(codec.ID())+"aaaaaaa.", codec)
+	if err != nil {
+		return nil, err
+	}
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	if udpSize > 0 {
+		req.SetEdns0(udpSize, false)
+		if pad {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &mdns.EDNS0_PADDING{Padding: make([]byte, dns.RecordEncoders[mdns.TypeTXT].Size(n)-req.Len())})
+		}
+	}
+	r, _, err := (&mdns.Client{Net: network, Timeout: 2 * time.Second}).Exchange(req, addr)
+	return r, err
+}
+
+// a resolver that drops the EDNS0 record from every query, so answers have to fit in 512 bytes
+func noEDNSProxy(t *testing.T, listen, upstream string) *mdns.Server {
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		q := req.Copy()
+		q.Extra = nil
+		r, err := exchange(q)
+		if err != nil {
+			return nil
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy
+}
+
+func Test_ProbeMTU_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30357", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// without probing, the defaults
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.ProbeMTU = false
+	if _, err := client.RPC("127.0.0.1:30357", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Stop()
+	if client.ByteLimit() != 2410 {
+		t.Fatal("ByteLimit changed without probing: ", client.ByteLimit())
+	}
+
+	// a direct path with EDNS0 takes much more than the defaults
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30357", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	limit := client.ByteLimit()
+	if limit <= 2410 {
+		t.Fatal("ByteLimit did not grow on a direct path: ", limit)
+	}
+	t.Log("probed ByteLimit: ", limit)
+
+	// and a bundle that big makes it through
+	if _, err := client.RPC("127.0.0.1:30357", api.ID, strings.Repeat("x", int(limit))); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a second host on a path that carries less brings the limit down, since bundles go to any host
+	proxy := noEDNSProxy(t, "127.0.0.1:30385", "127.0.0.1:30357")
+	defer proxy.Shutdown()
+	if _, err := client.RPC("127.0.0.1:30385", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.ByteLimit() >= limit {
+		t.Fatal("ByteLimit not lowered by a session on a smaller path: ", client.ByteLimit())
+	}
+
+	// a limit that was set stays set
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	client.SetByteLimit(1000)
+	if _, err := client.RPC("127.0.0.1:30357", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.ByteLimit() != 1000 {
+		t.Fatal("ByteLimit changed by probing after SetByteLimit: ", client.ByteLimit())
+	}
+}
+
+func Test_ProbeMTU_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30386", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// over UDP, a size probe gets no more than the query sent
+	r, err := sizeProbe("udp", "127.0.0.1:30386", 600, 1232, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(r.Answer) != 0 {
+		t.Fatal("size probe answered with more than the query sent")
+	}
+	if r, err = sizeProbe("udp", "127.0.0.1:30386", 600, 1232, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(r.Answer) == 0 || r.Truncated {
+		t.Fatal("padded size probe not answered")
+	}
+
+	// over TCP the source can't be spoofed, so it gets what it asks for
+	if r, err = sizeProbe("tcp", "127.0.0.1:30386", 600, 0, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(r.Answer) == 0 {
+		t.Fatal("size probe over TCP not answered")
+	}
+}
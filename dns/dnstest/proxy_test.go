@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+// proxyRewrite - what a proxy does with each query, exchange passes one on upstream, a nil answer sends none back
+type proxyRewrite func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg
+
+// startProxy - a resolver on listen that answers each query with rewrite, over network "udp" or "tcp"
+func startProxy(network, listen, upstream string, rewrite proxyRewrite) (*mdns.Server, error) {
+	client := &mdns.Client{Net: network, Timeout: 5 * time.Second} // longer than the server holds a poll
+	exchange := func(req *mdns.Msg) (*mdns.Msg, error) {
+		r, _, err := client.Exchange(req, upstream)
+		return r, err
+	}
+	proxy := &mdns.Server{Addr: listen, Net: network, UDPSize: mdns.DefaultMsgSize, Handler: mdns.HandlerFunc(func(w mdns.ResponseWriter, req *mdns.Msg) {
+		if r := rewrite(req, exchange); r != nil {
+			w.WriteMsg(r)
+		}
+	})}
+	started := make(chan struct{})
+	failed := make(chan error, 1)
+	proxy.NotifyStartedFunc = func() { close(started) }
+	go func() { failed <- proxy.ListenAndServe() }()
+	select {
+	case <-started:
+		return proxy, nil
+	case err := <-failed:
+		return nil, err
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_RPC_Timeout_1(t *testing.T) {
+
+	transport := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0xFFFFFFFF, 0xFFFFFFFF)
+	transport.RPCTimeout = 2 * time.Second
+
+	// nothing is listening here
+	start := time.Now()
+	_, err := transport.RPC("127.0.0.1:30999", api.ID)
+	if err == nil {
+		t.Fatal("RPC to a dead server did not fail")
+	}
+	var timeoutErr *dns.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("RPC to a dead server returned the wrong error: %T %v", err, err)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("TimeoutError is not a net.Error timeout")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("TimeoutError is not a context.DeadlineExceeded")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("RPC took too long to time out: ", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := transport.RPCContext(ctx, "127.0.0.1:30999", api.ID); err != context.Canceled {
+		t.Fatal("cancelled RPC returned the wrong error: ", err)
+	}
+}
+
+func Test_RPC_Timeout_2(t *testing.T) {
+
+	// a server that takes every query and never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:30401")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// setting up the session gives up at the deadline too, each probe would wait longer than it
+	transport := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0xFFFFFFFF, 0xFFFFFFFF)
+	transport.RPCTimeout = 2 * time.Second
+	defer transport.Stop()
+	start := time.Now()
+	_, err = transport.RPC("127.0.0.1:30401", api.ID)
+	var timeoutErr *dns.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("RPC to a silent server returned the wrong error: %T %v", err, err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("RPC took too long to time out: ", time.Since(start))
+	}
+}
+
+func Test_RPC_Concurrent_1(t *testing.T) {
+
+	// two servers, each with contacts of its own
+	hosts := []string{"127.0.0.1:30389", "127.0.0.1:30390"}
+	ids := make([]string, len(hosts))
+	for i, host := range hosts {
+		routingKey := new(ecc.KeyPair)
+		routingKey.GenerateKey()
+		node := ram.New(new(ecc.KeyPair), routingKey)
+		ids[i] = routingKey.GetPubKey().ToB64()
+		for j := 0; j < 8; j++ {
+			if err := node.AddContact(fmt.Sprintf("%d-%d", i, j), ids[i]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		server := dns.New(node, 0x11111111, 0x22222222)
+		server.Listen(host, true)
+		defer server.Stop()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// overlapping calls to one host and to both, each gets the response to its own call
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		for j := 0; j < 8; j++ {
+			wg.Add(2)
+			go func(i int, host string) {
+				defer wg.Done()
+				value, err := client.RPC(host, api.ID)
+				if err != nil {
+					t.Error(err.Error())
+				} else if id, ok := value.(bc.PubKey); !ok || id.ToB64() != ids[i] {
+					t.Error("ID of ", host, " answered with another: ", value)
+				}
+			}(i, host)
+			go func(name, host string) {
+				defer wg.Done()
+				value, err := client.RPC(host, api.GetContact, name)
+				if err != nil {
+					t.Error(err.Error())
+				} else if contact, ok := value.(*api.Contact); !ok || contact.Name != name {
+					t.Error("contact ", name, " from ", host, " answered with another: ", value)
+				}
+			}(fmt.Sprintf("%d-%d", i, j), host)
+		}
+	}
+	wg.Wait()
+}
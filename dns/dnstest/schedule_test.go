@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+func Test_MaxQPS_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30360", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// count the queries on their way through
+	var queries int64
+	proxy := &mdns.Server{Addr: "127.0.0.1:30361", Net: "udp", Handler: mdns.HandlerFunc(func(w mdns.ResponseWriter, req *mdns.Msg) {
+		atomic.AddInt64(&queries, 1)
+		c := &mdns.Client{ReadTimeout: 5 * time.Second}
+		if r, _, err := c.Exchange(req, "127.0.0.1:30360"); err == nil {
+			w.WriteMsg(r)
+		}
+	})}
+	started := make(chan struct{})
+	proxy.NotifyStartedFunc = func() { close(started) }
+	go proxy.ListenAndServe()
+	<-started
+	defer proxy.Shutdown()
+
+	client := dns.NewFromMap(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), map[string]interface{}{
+		"ClientConv":   uint32(0x22222222),
+		"ServerConv":   uint32(0x11111111),
+		"MaxQPS":       float64(1),
+		"PollInterval": "10ms",
+	}).(*dns.Module)
+	defer client.Stop()
+
+	start := time.Now()
+	if _, err := client.RPC("127.0.0.1:30361", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	elapsed := time.Since(start).Seconds()
+	if n := atomic.LoadInt64(&queries); float64(n) > elapsed+1 {
+		t.Fatalf("%d queries in %.1fs is over MaxQPS", n, elapsed)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+
+	mdns "github.com/miekg/dns"
+)
+
+// a resolver that passes queries through, and keeps a copy of every one for replaying later
+// the func it returns gives the copies so far
+func recordingProxy(t *testing.T, listen, upstream string) (*mdns.Server, func() []*mdns.Msg) {
+	var mutex sync.Mutex
+	var msgs []*mdns.Msg
+	proxy, err := startProxy("udp", listen, upstream, func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		mutex.Lock()
+		msgs = append(msgs, req.Copy())
+		mutex.Unlock()
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return proxy, func() []*mdns.Msg {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]*mdns.Msg(nil), msgs...)
+	}
+}
+
+func Test_Seal_1(t *testing.T) {
+
+	sessionKey := new(ecc.KeyPair)
+	if err := sessionKey.FromB64(pubprivkeyb64Ecc); err != nil {
+		t.Fatal(err.Error())
+	}
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.SessionKey = sessionKey
+	if err := server.Start("127.0.0.1:30363", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+	proxy, recorded := recordingProxy(t, "127.0.0.1:30364", "127.0.0.1:30363")
+	defer proxy.Shutdown()
+
+	// a client that knows the server's key gets through
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.ServerKey = pubkeyb64Ecc
+	if _, err := client.RPC("127.0.0.1:30364", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	client.Stop()
+
+	// every data query replayed is dropped before it reaches kcp
+	before := server.Stats().Rejected
+	for _, req := range recorded() {
+		mdns.Exchange(req, "127.0.0.1:30363")
+	}
+	if server.Stats().Rejected <= before {
+		t.Fatal("replayed segments were not rejected")
+	}
+
+	// a client expecting some other key gives up
+	other := new(ecc.KeyPair)
+	other.GenerateKey()
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.ServerKey = other.GetPubKey().ToB64()
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30363", api.ID); !errors.Is(err, dns.ErrHandshake) {
+		t.Fatal("handshake with the wrong server key did not fail: ", err)
+	}
+
+	// and so does one talking to a server that doesn't seal
+	plain := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	plain.Encrypt = false
+	if err := plain.Start("127.0.0.1:30365", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plain.Stop()
+	if _, err := client.RPC("127.0.0.1:30365", api.ID); !errors.Is(err, dns.ErrHandshake) {
+		t.Fatal("handshake with a server that doesn't seal did not fail: ", err)
+	}
+}
+
+func Test_Seal_2(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := server.Start("127.0.0.1:30383", false); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// without a ServerKey, the client pins the key the host sends first
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.RPCTimeout = 20 * time.Second
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30383", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the same server restarted still has its key
+	server.Stop()
+	if err := server.Start("127.0.0.1:30383", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := client.RPC("127.0.0.1:30383", api.ID); err != nil {
+		t.Fatal("RPC to a restarted server with the same key: ", err)
+	}
+	server.Stop()
+
+	// something else answering for the host with another key is refused
+	other := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := other.Start("127.0.0.1:30383", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Stop()
+	if _, err := client.RPC("127.0.0.1:30383", api.ID); !errors.Is(err, dns.ErrHandshake) {
+		t.Fatal("handshake with a key other than the pinned one did not fail: ", err)
+	}
+}
+
+func Test_Seal_3(t *testing.T) {
+
+	l, err := dns.Listen("127.0.0.1:30394", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+
+	// the server writes first, as soon as it has a stream
+	banner := []byte("a banner that never goes out in the clear")
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(banner)
+		ioutil.ReadAll(conn)
+	}()
+
+	var mutex sync.Mutex
+	clear := false
+	proxy, err := startProxy("udp", "127.0.0.1:30395", "127.0.0.1:30394", func(req *mdns.Msg, exchange func(*mdns.Msg) (*mdns.Msg, error)) *mdns.Msg {
+		labels := mdns.SplitDomainName(req.Question[0].Name)
+		if strings.ToLower(labels[len(labels)-1])[0] == 'n' {
+			time.Sleep(100 * time.Millisecond) // a slow path, so kcp has time to send before the handshake
+		}
+		r, err := exchange(req)
+		if err != nil {
+			return nil
+		}
+		segments, _ := dns.RecordEncoders[mdns.TypeTXT].Decode(r.Answer)
+		for _, b := range segments {
+			if bytes.Contains(b, banner) {
+				mutex.Lock()
+				clear = true
+				mutex.Unlock()
+			}
+		}
+		return r
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer proxy.Shutdown()
+
+	conn, err := dns.Dial("127.0.0.1:30395", map[string]interface{}{"PollMaxInterval": "200ms"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	got := make([]byte, len(banner))
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(got, banner) {
+		t.Fatal("banner changed on the way through: ", string(got))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if clear {
+		t.Fatal("data written before the handshake went out unsealed")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Session_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.Listen("127.0.0.1:30388", true)
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	pub := key.GetPubKey().ToB64()
+
+	// two clients with the same conv IDs, calling at once, each in a session of its own
+	clients := []*dns.Module{
+		dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111),
+		dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111),
+	}
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *dns.Module) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := client.RPC("127.0.0.1:30388", api.AddContact, fmt.Sprintf("client %d contact %d", i, j), pub); err != nil {
+					t.Error(err.Error())
+					return
+				}
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// every call made it through, so the server kept the sessions apart
+	value, err := clients[0].RPC("127.0.0.1:30388", api.GetContacts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if contacts, ok := value.([]api.Contact); !ok || len(contacts) != 10 {
+		t.Fatal("contacts lost on the way through: ", value)
+	}
+}
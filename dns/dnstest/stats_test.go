@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+func Test_Stats_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.HoldTimeout = 200 * time.Millisecond // so polls held with nothing to send come back empty before the client stops
+	if err := server.Start("127.0.0.1:30362", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30362", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// one client session, and the server session it talked to
+	cs := client.Stats()
+	c, ok := cs.Clients["127.0.0.1:30362"]
+	if !ok {
+		t.Fatal("no stats for the client session")
+	}
+	ss := server.Stats()
+	s, ok := ss.Sessions[c.ID]
+	if !ok {
+		t.Fatal("no stats for the server session")
+	}
+	t.Log(cs)
+	t.Log(ss)
+
+	if c.QueriesSent == 0 || c.Responses == 0 || c.Answers == 0 || c.UpstreamBytes == 0 || c.DownstreamBytes == 0 {
+		t.Fatal("client session counters missing: ", c.Counters)
+	}
+	if s.QueriesReceived == 0 || s.Responses == 0 || s.Answers == 0 || s.UpstreamBytes == 0 || s.DownstreamBytes == 0 {
+		t.Fatal("server session counters missing: ", s.Counters)
+	}
+	if cs.QueriesSent < c.QueriesSent || ss.QueriesReceived < s.QueriesReceived {
+		t.Fatal("module totals less than a session's")
+	}
+	if c.DecodeFailures != 0 || s.DecodeFailures != 0 {
+		t.Fatal("decode failures on a clean path")
+	}
+	if c.KCP.MTU == 0 || c.KCP.RecvWindow == 0 || s.KCP.MTU == 0 || s.KCP.SendWindow == 0 {
+		t.Fatal("kcp state missing: ", c.KCP, s.KCP)
+	}
+	// kcp-go state is read by field name, every one has to be there
+	for _, k := range []dns.KCPStats{c.KCP, s.KCP} {
+		if k.MTU < 0 || k.RTT < 0 || k.RTTVar < 0 || k.RTO < 0 || k.SendWindow < 0 || k.RecvWindow < 0 ||
+			k.RemoteWindow < 0 || k.CongestionWindow < 0 {
+			t.Fatal("kcp state not found in this version of kcp-go: ", k)
+		}
+	}
+	if !strings.HasPrefix(ss.String(), "dns stats:") {
+		t.Fatal("stats summary malformed: ", ss.String())
+	}
+
+	// polls the server held with nothing to send come back empty
+	if c.EmptyPolls == 0 || s.EmptyPolls == 0 {
+		t.Fatal("no empty polls counted: ", c.EmptyPolls, s.EmptyPolls)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet-transports/dns"
+	"github.com/awgh/ratnet/api"
+	"github.com/awgh/ratnet/nodes/ram"
+)
+
+const (
+	tsigSecret      = "c2VjcmV0IHNoYXJlZCBieSB0dW5uZWwgcGVlcnM="
+	tsigOtherSecret = "c29tZSBvdGhlciBzZWNyZXQ="
+)
+
+func Test_TSIG_1(t *testing.T) {
+
+	server := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	server.TSIGSecret = tsigSecret
+	if err := server.Start("127.0.0.1:30366", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	// a client with the key gets through, directly and over DoH
+	client := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.TSIGSecret = tsigSecret
+	if _, err := client.RPC("127.0.0.1:30366", api.ID); err != nil {
+		t.Fatal(err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", server.DoHHandler())
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+	client.HTTPClient = ts.Client()
+	if _, err := client.RPC(ts.URL+"/dns-query", api.ID); err != nil {
+		t.Fatal("DoH: ", err.Error())
+	}
+	client.Stop()
+	if server.Stats().Rejected != 0 {
+		t.Fatal("signed queries were rejected: ", server.Stats().Rejected)
+	}
+
+	// a client with some other key is refused, and can tell why
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.TSIGSecret = tsigOtherSecret
+	if _, err := client.RPC("127.0.0.1:30366", api.ID); !errors.Is(err, dns.ErrTSIG) {
+		t.Fatal("RPC with the wrong TSIG key did not fail: ", err)
+	}
+	client.Stop()
+
+	// and so is one that doesn't sign at all
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	if _, err := client.RPC("127.0.0.1:30366", api.ID); err == nil {
+		t.Fatal("RPC without TSIG got through")
+	}
+	client.Stop()
+	if server.Stats().Rejected == 0 {
+		t.Fatal("unsigned queries not counted as rejected")
+	}
+
+	// a signing client won't take unsigned answers from a server without the key
+	plain := dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x11111111, 0x22222222)
+	if err := plain.Start("127.0.0.1:30367", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer plain.Stop()
+	client = dns.New(ram.New(new(ecc.KeyPair), new(ecc.KeyPair)), 0x22222222, 0x11111111)
+	client.TSIGSecret = tsigSecret
+	defer client.Stop()
+	if _, err := client.RPC("127.0.0.1:30367", api.ID); !errors.Is(err, dns.ErrTSIG) {
+		t.Fatal("RPC to a server that doesn't sign did not fail: ", err)
+	}
+}
@@ -0,0 +1,209 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+)
+
+/*
+**  DNS-OVER-HTTPS (RFC 8484):  THE SAME TUNNEL QUERIES, CARRIED AS application/dns-message
+ */
+
+// dohContentType - the media type of a DNS message in a DoH request or response
+const dohContentType = "application/dns-message"
+
+// isDoH - returns true if host is a DoH URL rather than a DNS server address
+func isDoH(host string) bool {
+	return strings.HasPrefix(host, "https://") || strings.HasPrefix(host, "http://")
+}
+
+// exchangeDoH - sends a query to a DoH URL and returns the response, giving up after clientTimeout or when ctx is done
+func (m *Module) exchangeDoH(ctx context.Context, url string, req *mdns.Msg) (*mdns.Msg, error) {
+	q := req.Copy()
+	q.Id = 0 // RFC 8484 4.1, the HTTP exchange does the matching
+	packed, mac, err := m.packMsg(q, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clientTimeout)
+	defer cancel()
+
+	var hreq *http.Request
+	if strings.ToUpper(m.DoHMethod) == http.MethodGet {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		hreq, err = http.NewRequest(http.MethodGet, url+sep+"dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+	} else {
+		hreq, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(packed))
+		if err == nil {
+			hreq.Header.Set("Content-Type", dohContentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set("Accept", dohContentType)
+
+	httpClient := m.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH request failed: " + resp.Status)
+	}
+	body, err := readMsg(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(mdns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	if t := r.IsTsig(); t != nil && mac != "" {
+		if t.Hdr.Name != m.tsigKeyName() {
+			return nil, mdns.ErrSecret
+		}
+		if err := mdns.TsigVerify(body, m.TSIGSecret, mac, false); err != nil {
+			return nil, err
+		}
+	}
+	r.Id = req.Id
+	return r, nil
+}
+
+// packMsg - packs msg, signing it with the TSIG key if it has a TSIG record,
+// and returns the MAC it was signed with, requestMAC for a response
+func (m *Module) packMsg(msg *mdns.Msg, requestMAC string) ([]byte, string, error) {
+	if msg.IsTsig() == nil || !m.tsigEnabled() {
+		b, err := msg.Pack()
+		return b, "", err
+	}
+	return mdns.TsigGenerate(msg, m.TSIGSecret, requestMAC, false)
+}
+
+// DoHHandler - returns an http.Handler that answers DoH requests for this server,
+// to be mounted at a path like "/dns-query" on an HTTPS server or behind a TLS proxy
+// It starts the server, and answers 503 Service Unavailable once Stop is called, until Start or DoHHandler starts it again
+func (m *Module) DoHHandler() http.Handler {
+	m.startServer()
+	return http.HandlerFunc(m.serveDoH)
+}
+
+func (m *Module) serveDoH(w http.ResponseWriter, r *http.Request) {
+	if !m.IsRunningServer() {
+		http.Error(w, "server stopped", http.StatusServiceUnavailable)
+		return
+	}
+
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = readMsg(r.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(packed) == 0 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	req := new(mdns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohResponseWriter{remote: &net.TCPAddr{}}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		dw.remote = addr
+	}
+	if t := req.IsTsig(); t != nil && m.tsigEnabled() {
+		// what the mdns.Server does for its own ResponseWriters
+		dw.tsigStatus = mdns.ErrSecret
+		if t.Hdr.Name == m.tsigKeyName() {
+			dw.tsigStatus = mdns.TsigVerify(packed, m.TSIGSecret, "", false)
+		}
+		dw.tsigRequestMAC = t.MAC
+	}
+	m.handleDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "server failure", http.StatusInternalServerError)
+		return
+	}
+
+	out, _, err := m.packMsg(dw.msg, dw.tsigRequestMAC)
+	if err != nil {
+		http.Error(w, "server failure", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", "max-age=0") // answers have a TTL of 0
+	w.Write(out)
+}
+
+// dohResponseWriter - an mdns.ResponseWriter that keeps the reply for the HTTP response
+// The remote address is a TCPAddr, so handleDNS answers without a datagram size limit
+type dohResponseWriter struct {
+	remote         net.Addr
+	msg            *mdns.Msg
+	tsigStatus     error  // the request's TSIG verified, or why it didn't
+	tsigRequestMAC string // the request's TSIG MAC, signing the response covers it
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohResponseWriter) WriteMsg(msg *mdns.Msg) error {
+	w.msg = msg
+	return nil
+}
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	msg := new(mdns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(b), nil
+}
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// readMsg - reads a DNS message from an HTTP body, refusing anything too large to be one
+func readMsg(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, mdns.MaxMsgSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > mdns.MaxMsgSize {
+		return nil, errors.New("DNS message too large")
+	}
+	return b, nil
+}
@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  DNS-OVER-TLS (RFC 7858):  THE SAME TUNNEL QUERIES, OVER TCP-TLS TO PORT 853
+ */
+
+// dotScheme - prefix of an upstream host that should be reached over DoT, like "tls://192.0.2.1:853"
+const dotScheme = "tls://"
+
+// isDoT - returns true if host should be reached over DoT
+func isDoT(host string) bool {
+	return strings.HasPrefix(host, dotScheme)
+}
+
+// CertPin - returns the pin for a PEM certificate, the base64 SHA-256 of its public key, for use in TLSPins
+func CertPin(certPem []byte) (string, error) {
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return "", errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return spkiPin(cert), nil
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsClientConfig - the client TLS config for a DoT server at addr
+// With pins set, the server's certificate must match one, and needn't chain to a trusted root
+func (m *Module) tlsClientConfig(addr string) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+	if len(m.TLSPins) == 0 {
+		return config
+	}
+
+	pins := m.TLSPins
+	config.InsecureSkipVerify = true // replaced by the pin check
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("DoT server sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		pin := spkiPin(cert)
+		for _, p := range pins {
+			if p == pin {
+				return nil
+			}
+		}
+		return errors.New("DoT server certificate does not match any pin: " + pin)
+	}
+	return config
+}
+
+// tlsServerConfig - the server TLS config, generating a self-signed certificate if none is set
+func (m *Module) tlsServerConfig() (*tls.Config, error) {
+	if len(m.Cert) == 0 || len(m.Key) == 0 {
+		certPem, keyPem, err := bc.GenerateSSLCertBytes(true)
+		if err != nil {
+			return nil, err
+		}
+		m.Cert, m.Key = certPem, keyPem
+		if pin, err := CertPin(certPem); err == nil {
+			events.Info(m.node, "dns generated a self-signed DoT certificate, pin: "+pin)
+		}
+	}
+	cert, err := tls.X509KeyPair(m.Cert, m.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -1,58 +1,101 @@
 package dns
 
 import (
-	"encoding/base32"
 	"errors"
+	"strings"
+
+	mdns "github.com/miekg/dns"
 )
 
 //
 //  UTILS
 //
 
+// maxNameLen - DNS maxlen is 253 for an FQDN in presentation format
+const maxNameLen = 253
+
+// ErrOutOfZone - returned when a name is not under the tunnel domain
+var ErrOutOfZone = errors.New("name is not under the tunnel domain")
+
+// labelLen - octets per label, a label can hold 63
+const labelLen = 60
+
 // Dotify - dotifies a string
 func Dotify(data []byte) (string, error) {
+	return DotifyDomain(data, "")
+}
 
-	b32s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data[:])
-	bs := 60 // must be smaller than 62 or 63???
-	l := len(b32s)
-	if l > 241 { // double-check limit
-		return "", errors.New("dotify - DNS maxlen is 253 for FQDN, so 241 before dotify")
-	}
-	i := l / bs
-	var output []byte
-	x := 0
-	for x = 0; x < i; x++ {
-		tmp := []byte(b32s)[x*bs : (x*bs)+bs]
-		tmp = append(tmp, '.')
-		output = append(output, tmp...)
+// DotifyDomain - dotifies a string and appends the tunnel domain, like "t.example.org."
+func DotifyDomain(data []byte, domain string) (string, error) {
+	return DotifyCodec(data, domain, base32Codec)
+}
+
+// DotifyCodec - dotifies a string with the given name codec and appends the tunnel domain
+func DotifyCodec(data []byte, domain string, codec NameCodec) (string, error) {
+	if dotifiedLen(codec, len(data))+len(domain) > maxNameLen { // double-check limit
+		return "", errors.New("dotify - DNS maxlen is 253 for FQDN, including the domain")
 	}
-	tmp := []byte(b32s)[x*bs:]
-	tmplen := byte(len(tmp))
-	if tmplen > 0 {
-		tmp = append(tmp, '.')
-		output = append(output, tmp...)
+	encoded := codec.Encode(data)
+	var output strings.Builder
+	for len(encoded) > 0 {
+		n := labelLen
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		output.WriteString(escapeLabel(encoded[:n]))
+		output.WriteByte('.')
+		encoded = encoded[n:]
 	}
-	return string(output), nil
+	return output.String() + domain, nil
 }
 
 // Undotify - un-dotifies a string
 func Undotify(data string) ([]byte, error) {
+	return UndotifyCodec(data, "", base32Codec)
+}
 
-	datalen := len(data)
-	output := ""
-
-	for i := 0; i < datalen; i++ {
-		var b byte
-		b = data[i]
+// UndotifyDomain - strips the tunnel domain from a name, then un-dotifies the rest
+func UndotifyDomain(data string, domain string) ([]byte, error) {
+	return UndotifyCodec(data, domain, base32Codec)
+}
 
-		if b == '.' {
-			continue
+// UndotifyCodec - strips the tunnel domain from a name, then un-dotifies the rest with the given name codec
+func UndotifyCodec(data string, domain string, codec NameCodec) ([]byte, error) {
+	if domain != "" {
+		if !mdns.IsSubDomain(domain, data) {
+			return nil, ErrOutOfZone
 		}
-		output += string(b)
+		data = data[:len(data)-len(domain)]
 	}
-	outbytes, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(output)
-	if err != nil {
-		return nil, err
+	var encoded []byte
+	for _, label := range mdns.SplitDomainName(data) {
+		b, err := unescapeLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, b...)
+	}
+	return codec.Decode(encoded)
+}
+
+// MaxDotifyLen - the most bytes that DotifyDomain can fit into one name under domain
+func MaxDotifyLen(domain string) int {
+	return maxDotifyLen(base32Codec, domain)
+}
+
+// maxDotifyLen - the most bytes that DotifyCodec can fit into one name under domain
+func maxDotifyLen(codec NameCodec, domain string) int {
+	n := maxNameLen - len(domain)
+	for n > 0 && dotifiedLen(codec, n)+len(domain) > maxNameLen {
+		n--
 	}
-	return outbytes, nil
+	return n
+}
+
+// dotifiedLen - length of the name DotifyCodec produces for n bytes of data, counting
+// label octets rather than escapes, and including the dots
+func dotifiedLen(codec NameCodec, n int) int {
+	encodedLen := codec.EncodedLen(n)
+	labels := (encodedLen + labelLen - 1) / labelLen
+	return encodedLen + labels
 }
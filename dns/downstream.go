@@ -2,9 +2,7 @@ package dns
 
 import (
 	"fmt"
-	"math"
 	"net"
-	"time"
 
 	mdns "github.com/miekg/dns"
 
@@ -16,137 +14,282 @@ import (
 **  DOWNSTREAM DIRECTION:  FROM THIS SERVER OUTBOUND TO A REMOTE CLIENT
  */
 
-// WriteDownstream - Writes KCP data to the DNS Client via DNS Responses
-func (m *Module) WriteDownstream(buf []byte, size int) {
-	b := make([]byte, size)
-	copy(b, buf[:size])
-	m.downstreamKCPData <- b
-}
-
 func (m *Module) handleDNS(w mdns.ResponseWriter, req *mdns.Msg) {
 	events.Info(m.node, fmt.Sprintf("\n***\n***handleDNS called:  client:%x server:%x\n***\n", m.ClientConv, m.ServerConv))
 
+	// the cheap checks first, before any work for the query
+	if m.MaxQuerySize > 0 && req.Len() > m.MaxQuerySize {
+		m.limitHit(limitSize, nil, w.RemoteAddr())
+		m.refuseOverLimit(w, req)
+		return
+	}
+	if !m.allowSource(w.RemoteAddr()) {
+		m.limitHit(limitSource, nil, w.RemoteAddr())
+		m.refuseOverLimit(w, req)
+		return
+	}
+
 	msg := new(mdns.Msg)
 	msg.SetReply(req)
 	msg.SetRcode(req, mdns.RcodeSuccess)
+	if err := m.checkQuery(w, req); err != nil {
+		// RFC 8945 5.3.2, unsigned so a peer with some other key can tell
+		m.count(nil, statRejected, 1)
+		events.Warning(m.node, "handleDNS refused query: "+err.Error())
+		msg.SetRcode(req, mdns.RcodeNotAuth)
+		w.WriteMsg(msg)
+		return
+	} else if m.tsigEnabled() {
+		w = &tsigWriter{ResponseWriter: w, name: m.tsigKeyName()}
+	}
+	if len(req.Question) == 0 {
+		w.WriteMsg(msg)
+		return
+	}
 
-	for i := range req.Question {
-		if req.Question[i].Qtype == mdns.TypeMX {
-			events.Info(m.node, "handleDNS Server got MX type, continuing...")
-			continue
+	// strip the tunnel domain and header label, undotify then base32 decode
+	zone := m.zone()
+	kind, id, data, err := parseQueryName(req.Question[0].Name, zone)
+	m.count(nil, statQueriesReceived, 1)
+	if err == ErrOutOfZone {
+		events.Warning(m.node, "handleDNS refused query outside of tunnel domain:", req.Question[0].Name)
+		msg.SetRcode(req, mdns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	} else if err != nil {
+		// not one of ours, or mangled by a resolver: answer empty rather than NXDOMAIN,
+		// so resolvers doing qname minimisation still come back for the full name
+		m.count(nil, statDecodeFailures, 1)
+		events.Warning(m.node, "handleDNS error:", err)
+		w.WriteMsg(msg)
+		return
+	}
+
+	var s *session // probes are answered without one
+	if kind != queryProbe {
+		if s = m.liveSession(id); s == nil {
+			// forgotten after sessionTimeout or a restart, or never opened by a probe: the client starts over
+			events.Warning(m.node, fmt.Sprintf("handleDNS query for unknown session %08x", id))
+			msg.SetRcode(req, mdns.RcodeNameError)
+			w.WriteMsg(msg)
+			return
+		}
+		s.counters.add(statQueriesReceived, 1)
+		if !m.allowSession(s) {
+			m.limitHit(limitSession, s, w.RemoteAddr())
+			m.refuseOverLimit(w, req)
+			return
 		}
-		// undotify then base32 decode
-		data, err := Undotify(req.Question[i].Name)
+	}
+	m.count(s.stats(), statUpstreamBytes, len(data))
+	if kind == queryData && len(data) > 0 {
+		// pass the incoming data into this session's kcp, if it is sealed with the session's keys, with any FEC rebuilt
+		s.mutex.Lock()
+		packets, recovered, err := m.unwrapSegment(s.sealer, s.fec, data)
+		for _, packet := range packets {
+			s.kcp.Input(packet, true, false)
+		}
+		ready := len(packets) > 0 && s.kcp.PeekSize() > 0
+		s.mutex.Unlock()
+		m.count(&s.counters, statRecovered, recovered)
 		if err != nil {
-			events.Error(m.node, "handleDNS error:", err)
-		} else {
-			// pass the incoming data into kcp
-			m.serverMutex.Lock()
-			m.kcpServer.Input(data, true, false)
-			m.serverMutex.Unlock()
+			m.count(&s.counters, dropStat(err), 1)
+			events.Warning(m.node, "handleDNS dropped segment: "+err.Error())
+		}
+		if ready {
+			go m.serverUpdate(s)
 		}
 	}
 
-	// scrub out the original name to save space, matching transaction ID is all you need anyway
-	msg.Question = make([]mdns.Question, 1)
-	msg.Question[0] = mdns.Question{Name: "mail.", Qtype: req.Question[0].Qtype, Qclass: mdns.ClassINET}
+	// the client picks the downstream encoding by the record type it asks for
+	enc, ok := RecordEncoders[req.Question[0].Qtype]
+	if !ok {
+		events.Warning(m.node, "handleDNS no encoder for query type:", mdns.TypeToString[req.Question[0].Qtype])
+		w.WriteMsg(msg)
+		return
+	}
 
-	// fetch outbound data from kcp and load into response
-	var answers []mdns.RR
-	var item []byte
+	owner := req.Question[0].Name
+	if zone == "" {
+		// scrub out the original name to save space, matching transaction ID is all you need anyway
+		msg.Question = make([]mdns.Question, 1)
+		msg.Question[0] = mdns.Question{Name: scrubName, Qtype: req.Question[0].Qtype, Qclass: mdns.ClassINET}
+		owner = scrubName
+	} else {
+		// resolvers need the question echoed back, and an authoritative answer for our zone
+		msg.Authoritative = true
+	}
+	msg.Compress = true // answers are owned by the question name, this makes them pointers
 
-	select {
-	case item = <-m.downstreamKCPData:
+	// answer as much as the client can take: 512 bytes, its EDNS0 buffer size, or a TCP message
+	limit := mdns.MinMsgSize
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	if tcp {
+		limit = mdns.MaxMsgSize
+	} else if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > limit {
+		limit = int(opt.UDPSize())
+		if limit > mdns.DefaultMsgSize {
+			limit = mdns.DefaultMsgSize
+		}
+	}
+	if req.IsEdns0() != nil {
+		msg.SetEdns0(mdns.DefaultMsgSize, false)
+	}
 
-		// base32 encode, then dotify / "DNS chop"
-		b32s, err := Dotify(item)
-		if err != nil {
-			events.Error(m.node, err)
+	// fetch outbound data from kcp and load into response, starting with anything held back from a truncated response
+	var segments [][]byte
+	if kind == queryProbe {
+		// a size probe over UDP gets no more answer bytes than it sent, so a spoofed source can't use it as an amplifier
+		most := mdns.MaxMsgSize
+		if !tcp {
+			most = req.Len()
+			for most > 0 && enc.Size(most) > req.Len() {
+				most--
+			}
+		}
+		if segments, err = m.answerProbe(id, data, most); err != nil {
+			events.Warning(m.node, "handleDNS error:", err)
+			w.WriteMsg(msg)
 			return
 		}
-		rr := new(mdns.A)
-		rr.Hdr = mdns.RR_Header{Name: b32s, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 0}
-		rr.A = net.ParseIP("192.168.1.1") // todo: this should be data
-		answers = append(answers, rr)
-		break
-	case <-time.After(serverTimeout): // nothing's ready to go, send empty response
-		// no answer, nothing to send
+	} else if segments = s.takeHeld(); len(segments) == 0 {
+		item := m.awaitDownstream(s, kind == queryData, func() { m.limitHit(limitHeld, s, w.RemoteAddr()) })
+		if item != nil {
+			segments = append(segments, item)
+		}
 	}
-	msg.Answer = answers
 
-	maxItemSize := math.Ceil(1.6*float64(mtu)) + 15 // base32 overhead plus 15 bytes per-answer overhead
-	ok := true
-	// opportunistically grab up to 10 more, without exceeding max DNS message length of 512
-	// practically speaking, this will usually only grab up 1 or 2 more
-	for i := 0; ok && i < 10; i++ { // ten is max number of answers
-		if float64(512-msg.Len()) < maxItemSize {
+	used := msg.Len()
+	for _, item := range segments {
+		used += enc.Size(len(item))
+	}
+	// opportunistically grab more, without exceeding the max DNS message length
+	for more := s != nil && len(segments) > 0; more && len(segments) < enc.MaxSegments(); {
+		if used+enc.Size(s.getMTU()) > limit {
 			break
 		}
 
 		select {
-		case item = <-m.downstreamKCPData:
-			ok = true
-			// base32 encode, then dotify / "DNS chop"
-			b32s, err := Dotify(item)
-			if err != nil {
-				events.Error(m.node, err)
-				return
-			}
-			rr := new(mdns.A)
-			rr.Hdr = mdns.RR_Header{Name: b32s, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 0}
-			rr.A = net.ParseIP("192.168.1.1") // todo: this should be data
-			answers = append(answers, rr)
+		case item := <-s.downstream:
+			segments = append(segments, item)
+			used += enc.Size(len(item))
 		default:
-			ok = false
+			more = false
 		}
-		msg.Answer = answers
+	}
+
+	answers, err := enc.Encode(owner, segments)
+	if err != nil {
+		events.Error(m.node, err)
+		return
+	}
+	msg.Answer = answers
+
+	if msg.Len() > limit {
+		// doesn't fit in a datagram, hold the data for the client to retry over TCP
+		if s != nil {
+			s.hold(segments)
+		}
+		msg.Answer = nil
+		msg.Truncated = true
+	} else {
+		m.count(s.stats(), statAnswers, len(segments))
+		for _, item := range segments {
+			m.count(s.stats(), statDownstreamBytes, len(item))
+		}
+	}
+	m.count(s.stats(), statResponses, 1)
+	if kind == queryPoll && len(segments) == 0 {
+		m.count(s.stats(), statEmptyPolls, 1)
 	}
 
 	events.Info(m.node, "handleDNS Server packed answers:", len(answers), " msg len: ", msg.Len())
 	w.WriteMsg(msg)
-
-	m.debouncerServerUpdate.Trigger()
 }
 
-// pulls from kcpServer (userdata), passes to node, responses to kcpServer (userdata)
-func (m *Module) serverUpdate() {
-	buffer := make([]byte, maxMsgSize)
-	m.serverMutex.Lock()
-	n := m.kcpServer.Recv(buffer)
-	m.serverMutex.Unlock()
-	if n > 0 {
-		// handle response
-		am, err := api.RemoteCallFromBytes(&buffer)
+// pulls from a session's kcp (userdata), passes to node, responses to the same session's kcp (userdata)
+// A stream session is left for its reader instead
+func (m *Module) serverUpdate(s *session) {
+	if m.listener != nil {
+		if conn := s.stream(); conn != nil {
+			conn.signal()
+		}
+		return // stream sessions have nothing for the node
+	}
+	s.rpcMutex.Lock()
+	defer s.rpcMutex.Unlock()
+
+	for {
+		s.mutex.Lock()
+		frames, err := s.frames.recv(s.kcp)
+		s.mutex.Unlock()
 		if err != nil {
+			m.count(&s.counters, statDecodeFailures, 1)
 			events.Warning(m.node, "dns Server Recv decode failed: "+err.Error())
+		}
+		if len(frames) == 0 {
 			return
 		}
+		for _, f := range frames {
+			m.answerCall(s, f)
+		}
+	}
+}
 
-		events.Info(m.node, fmt.Sprintf("serverUpdate received: %d, %+v\n", (*am).Action, (*am).Args))
+// answerCall - passes one RemoteCall frame to the node, and queues its response in the session's kcp
+func (m *Module) answerCall(s *session, f []byte) {
+	s.mutex.Lock()
+	compress := s.compress
+	s.mutex.Unlock()
 
-		rr := api.RemoteResponse{}
-		if m.node != nil {
-			var result interface{}
-			if m.adminMode {
-				result, err = m.node.AdminRPC(m, *am)
-			} else {
-				result, err = m.node.PublicRPC(m, *am)
-			}
-			if err != nil {
-				rr.Error = err.Error()
-			}
-			if result != nil {
-				rr.Value = result
-			}
+	id, b, err := unframe(f)
+	if err == nil && compress {
+		b, err = decompressPayload(b)
+	}
+	if err != nil {
+		m.count(&s.counters, statDecodeFailures, 1)
+		events.Warning(m.node, "dns Server Recv decode failed: "+err.Error())
+		return
+	}
+	am, err := api.RemoteCallFromBytes(&b)
+	if err != nil {
+		m.count(&s.counters, statDecodeFailures, 1)
+		events.Warning(m.node, "dns Server Recv decode failed: "+err.Error())
+		return
+	}
+
+	events.Info(m.node, fmt.Sprintf("serverUpdate received: %d, %+v\n", (*am).Action, (*am).Args))
+
+	rr := api.RemoteResponse{}
+	if m.node != nil {
+		var result interface{}
+		if m.adminMode {
+			result, err = m.node.AdminRPC(m, *am)
 		} else {
-			rr.Error = "No Node Assigned to Transport!"
+			result, err = m.node.PublicRPC(m, *am)
+		}
+		if err != nil {
+			rr.Error = err.Error()
 		}
+		if result != nil {
+			rr.Value = result
+		}
+	} else {
+		rr.Error = "No Node Assigned to Transport!"
+	}
 
-		events.Info(m.node, fmt.Sprintf("serverUpdate returned Error: %s, Value: %+v", rr.Error, rr.Value))
-		outb := api.RemoteResponseToBytes(&rr)
+	events.Info(m.node, fmt.Sprintf("serverUpdate returned Error: %s, Value: %+v", rr.Error, rr.Value))
+	outb := api.RemoteResponseToBytes(&rr)
+	payload := *outb
+	if compress {
+		payload = m.compressPayload(&s.counters, payload)
+	}
 
-		m.serverMutex.Lock()
-		m.kcpServer.Send(*outb)
-		m.serverMutex.Unlock()
+	size := s.msgSize(m.sealOverhead())
+	s.mutex.Lock()
+	err = sendFrame(s.kcp, id, payload, size)
+	s.mutex.Unlock()
+	if err != nil {
+		events.Warning(m.node, "dns Server Send failed: "+err.Error())
 	}
 }
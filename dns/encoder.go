@@ -0,0 +1,316 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+)
+
+/*
+**  DOWNSTREAM RECORD ENCODERS:  HOW KCP SEGMENTS ARE PACKED INTO DNS ANSWERS
+ */
+
+// rrHeaderSize - bytes per answer for a compressed owner name plus type, class, ttl and rdlength
+const rrHeaderSize = 12
+
+// RecordEncoder - packs downstream KCP segments into the answer section of a DNS response
+// The client picks the encoder for its session by the record type it queries for
+type RecordEncoder interface {
+	// Type - the DNS record type this encoder answers with
+	Type() uint16
+	// MaxSegments - the most segments that can be carried in a single response
+	MaxSegments() int
+	// Size - the worst-case number of answer bytes needed to carry a segment of n bytes
+	Size(n int) int
+	// Encode - packs segments into answer records owned by name
+	Encode(name string, segments [][]byte) ([]mdns.RR, error)
+	// Decode - recovers segments from the answer records of a response
+	Decode(answers []mdns.RR) ([][]byte, error)
+}
+
+// RecordEncoders - all known downstream record encoders, by record type
+var RecordEncoders = map[uint16]RecordEncoder{
+	mdns.TypeTXT:   txtEncoder{},
+	mdns.TypeNULL:  nullEncoder{},
+	mdns.TypeCNAME: cnameEncoder{},
+	mdns.TypeMX:    mxEncoder{},
+	mdns.TypeA:     addrEncoder{rrtype: mdns.TypeA, size: net.IPv4len},
+	mdns.TypeAAAA:  addrEncoder{rrtype: mdns.TypeAAAA, size: net.IPv6len},
+}
+
+// RecordEncoderByName - looks up a record encoder by record type name, like "TXT"
+func RecordEncoderByName(name string) (RecordEncoder, error) {
+	rrtype, ok := mdns.StringToType[strings.ToUpper(name)]
+	if !ok {
+		return nil, errors.New("unknown DNS record type: " + name)
+	}
+	enc, ok := RecordEncoders[rrtype]
+	if !ok {
+		return nil, errors.New("no downstream encoder for DNS record type: " + name)
+	}
+	return enc, nil
+}
+
+//
+//  TXT - base64 in character-strings
+//
+
+type txtEncoder struct{}
+
+func (txtEncoder) Type() uint16     { return mdns.TypeTXT }
+func (txtEncoder) MaxSegments() int { return 10 }
+
+func (txtEncoder) Size(n int) int {
+	b64len := base64.RawStdEncoding.EncodedLen(n)
+	return rrHeaderSize + b64len + (b64len+254)/255
+}
+
+func (txtEncoder) Encode(name string, segments [][]byte) ([]mdns.RR, error) {
+	var answers []mdns.RR
+	for _, seg := range segments {
+		s := base64.RawStdEncoding.EncodeToString(seg)
+		var txt []string
+		for len(s) > 255 {
+			txt = append(txt, s[:255])
+			s = s[255:]
+		}
+		txt = append(txt, s)
+		rr := new(mdns.TXT)
+		rr.Hdr = mdns.RR_Header{Name: name, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: 0}
+		rr.Txt = txt
+		answers = append(answers, rr)
+	}
+	return answers, nil
+}
+
+func (txtEncoder) Decode(answers []mdns.RR) ([][]byte, error) {
+	var segments [][]byte
+	for _, answer := range answers {
+		rr, ok := answer.(*mdns.TXT)
+		if !ok {
+			continue
+		}
+		seg, err := base64.RawStdEncoding.DecodeString(strings.Join(rr.Txt, ""))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+//
+//  NULL - raw bytes in rdata
+//
+
+type nullEncoder struct{}
+
+func (nullEncoder) Type() uint16     { return mdns.TypeNULL }
+func (nullEncoder) MaxSegments() int { return 10 }
+func (nullEncoder) Size(n int) int   { return rrHeaderSize + n }
+
+func (nullEncoder) Encode(name string, segments [][]byte) ([]mdns.RR, error) {
+	var answers []mdns.RR
+	for _, seg := range segments {
+		rr := new(mdns.NULL)
+		rr.Hdr = mdns.RR_Header{Name: name, Rrtype: mdns.TypeNULL, Class: mdns.ClassINET, Ttl: 0}
+		rr.Data = string(seg)
+		answers = append(answers, rr)
+	}
+	return answers, nil
+}
+
+func (nullEncoder) Decode(answers []mdns.RR) ([][]byte, error) {
+	var segments [][]byte
+	for _, answer := range answers {
+		if rr, ok := answer.(*mdns.NULL); ok {
+			segments = append(segments, []byte(rr.Data))
+		}
+	}
+	return segments, nil
+}
+
+//
+//  CNAME - dotified base32 in the target name, only one CNAME per owner is legal
+//
+
+type cnameEncoder struct{}
+
+func (cnameEncoder) Type() uint16     { return mdns.TypeCNAME }
+func (cnameEncoder) MaxSegments() int { return 1 }
+func (cnameEncoder) Size(n int) int   { return rrHeaderSize + dotifiedLen(base32Codec, n) + 1 }
+
+func (cnameEncoder) Encode(name string, segments [][]byte) ([]mdns.RR, error) {
+	var answers []mdns.RR
+	for _, seg := range segments {
+		target, err := Dotify(seg)
+		if err != nil {
+			return nil, err
+		}
+		rr := new(mdns.CNAME)
+		rr.Hdr = mdns.RR_Header{Name: name, Rrtype: mdns.TypeCNAME, Class: mdns.ClassINET, Ttl: 0}
+		rr.Target = target
+		answers = append(answers, rr)
+	}
+	return answers, nil
+}
+
+func (cnameEncoder) Decode(answers []mdns.RR) ([][]byte, error) {
+	var segments [][]byte
+	for _, answer := range answers {
+		rr, ok := answer.(*mdns.CNAME)
+		if !ok {
+			continue
+		}
+		seg, err := Undotify(rr.Target)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+//
+//  MX - dotified base32 in the exchange name
+//
+
+type mxEncoder struct{}
+
+func (mxEncoder) Type() uint16     { return mdns.TypeMX }
+func (mxEncoder) MaxSegments() int { return 10 }
+func (mxEncoder) Size(n int) int   { return rrHeaderSize + 2 + dotifiedLen(base32Codec, n) + 1 }
+
+func (mxEncoder) Encode(name string, segments [][]byte) ([]mdns.RR, error) {
+	var answers []mdns.RR
+	for i, seg := range segments {
+		mx, err := Dotify(seg)
+		if err != nil {
+			return nil, err
+		}
+		rr := new(mdns.MX)
+		rr.Hdr = mdns.RR_Header{Name: name, Rrtype: mdns.TypeMX, Class: mdns.ClassINET, Ttl: 0}
+		rr.Preference = uint16(10 * (i + 1))
+		rr.Mx = mx
+		answers = append(answers, rr)
+	}
+	return answers, nil
+}
+
+func (mxEncoder) Decode(answers []mdns.RR) ([][]byte, error) {
+	var segments [][]byte
+	for _, answer := range answers {
+		rr, ok := answer.(*mdns.MX)
+		if !ok {
+			continue
+		}
+		seg, err := Undotify(rr.Mx)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+//
+//  A / AAAA - length-prefixed segments spread across address rdata
+//
+//  Resolvers shuffle the records of an RRset, so the first byte of every address
+//  is its index in the stream, leaving 3 (A) or 15 (AAAA) data bytes per record.
+//
+
+type addrEncoder struct {
+	rrtype uint16
+	size   int
+}
+
+func (e addrEncoder) Type() uint16 { return e.rrtype }
+
+// MaxSegments - an A RRset tops out at 256 records of 3 bytes, so only a few segments fit
+func (e addrEncoder) MaxSegments() int {
+	if e.rrtype == mdns.TypeA {
+		return 4
+	}
+	return 10
+}
+
+func (e addrEncoder) Size(n int) int {
+	records := (n + 2 + e.size - 2) / (e.size - 1)
+	return records * (rrHeaderSize + e.size)
+}
+
+func (e addrEncoder) Encode(name string, segments [][]byte) ([]mdns.RR, error) {
+	var stream []byte
+	for _, seg := range segments {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(seg)))
+		stream = append(stream, l...)
+		stream = append(stream, seg...)
+	}
+	chunk := e.size - 1
+	if (len(stream)+chunk-1)/chunk > 256 {
+		return nil, errors.New("too much data for one address RRset")
+	}
+
+	var answers []mdns.RR
+	for i := 0; len(stream) > 0; i++ {
+		addr := make(net.IP, e.size)
+		addr[0] = byte(i)
+		n := copy(addr[1:], stream)
+		stream = stream[n:]
+
+		hdr := mdns.RR_Header{Name: name, Rrtype: e.rrtype, Class: mdns.ClassINET, Ttl: 0}
+		if e.rrtype == mdns.TypeA {
+			answers = append(answers, &mdns.A{Hdr: hdr, A: addr})
+		} else {
+			answers = append(answers, &mdns.AAAA{Hdr: hdr, AAAA: addr})
+		}
+	}
+	return answers, nil
+}
+
+func (e addrEncoder) Decode(answers []mdns.RR) ([][]byte, error) {
+	var addrs []net.IP
+	for _, answer := range answers {
+		switch rr := answer.(type) {
+		case *mdns.A:
+			if e.rrtype == mdns.TypeA {
+				addrs = append(addrs, rr.A.To4())
+			}
+		case *mdns.AAAA:
+			if e.rrtype == mdns.TypeAAAA {
+				addrs = append(addrs, rr.AAAA.To16())
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i][0] < addrs[j][0] })
+
+	var stream []byte
+	for i, addr := range addrs {
+		if len(addr) != e.size || int(addr[0]) != i {
+			return nil, errors.New("missing or duplicate address record in answer")
+		}
+		stream = append(stream, addr[1:]...)
+	}
+
+	var segments [][]byte
+	for len(stream) >= 2 {
+		l := int(binary.BigEndian.Uint16(stream))
+		if l == 0 {
+			break // padding
+		}
+		stream = stream[2:]
+		if l > len(stream) {
+			return nil, errors.New("truncated segment in address records")
+		}
+		segments = append(segments, stream[:l])
+		stream = stream[l:]
+	}
+	return segments, nil
+}
@@ -0,0 +1,7 @@
+//go:build debug
+// +build debug
+
+package dns
+
+// eventsOn - ratnet delivers events in builds with the debug tag, so stats are worth building for them
+const eventsOn = true
@@ -0,0 +1,7 @@
+//go:build !debug
+// +build !debug
+
+package dns
+
+// eventsOn - ratnet drops events in builds without the debug tag, so stats aren't built for them
+const eventsOn = false
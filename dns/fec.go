@@ -0,0 +1,316 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+/*
+**  FORWARD ERROR CORRECTION:  REED-SOLOMON PARITY BETWEEN KCP AND THE QUERY NAMES AND ANSWERS
+**
+**  Resolvers drop queries, and waiting out a kcp retransmit costs seconds. With ParityShards set,
+**  every DataShards kcp packets a session sends are followed by ParityShards parity packets, and
+**  the far end rebuilds up to ParityShards lost packets of a group as soon as enough of it arrives.
+**  The client asks for FEC in a probe at session start, and the server uses the same shard counts
+**  for its answers. A lost answer is asked for again, and the session set up over if none comes,
+**  so the ends never disagree on FEC. Every packet, sealed if the session seals, is:
+**
+**     <group><shard index><data shard: packet length, kcp packet | parity shard: data shards in the group, parity>
+**
+**  Data shards go to kcp as they arrive, parity only matters when something is lost. A group that
+**  stops short, at the end of an exchange, gets its parity once no packet has joined it for
+**  fecFlushDelay, as if the rest of its data shards were zeros.
+ */
+
+const (
+	// fecHeaderLen - the group number and shard index in front of every shard
+	fecHeaderLen = 5
+
+	// fecOverhead - the bytes FEC adds to a kcp packet, the header and the packet length,
+	// and one more for the data shard count parity carries, parity is as long as the longest data shard after it
+	fecOverhead = fecHeaderLen + 2 + 1
+
+	// fecWindow - groups older than this many behind the newest are given up on
+	fecWindow = 32
+
+	// defaultDataShards - kcp packets per FEC group, unless configured otherwise
+	defaultDataShards = 10
+
+	// fecFlushDelay - a group short of its data shards this long after its last one is sent with what it has, well before kcp resends
+	fecFlushDelay = 50 * time.Millisecond
+)
+
+var errBadShard = errors.New("dns FEC shard malformed")
+
+// fec - the FEC state for one end of a session, guarded by the kcp mutex
+type fec struct {
+	data, parity int
+	rs           reedsolomon.Encoder
+
+	// sending
+	group  uint32
+	shards [][]byte  // data shards of the group being sent, length prefixed
+	sent   time.Time // when the last of them was sent
+
+	// receiving
+	groups map[uint32]*fecGroup
+	newest uint32
+}
+
+// fecGroup - the shards of one group received so far
+type fecGroup struct {
+	shards [][]byte
+	count  int
+	short  bool // a parity shard said how many data shards the group has, the rest count as zeros
+	done   bool // every data shard arrived or was rebuilt, later shards are ignored
+}
+
+func newFEC(data, parity int) (*fec, error) {
+	if data < 1 || parity < 1 || data > 255 || parity > 255 {
+		return nil, errors.New("dns FEC shard counts must be from 1 to 255")
+	}
+	rs, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	return &fec{data: data, parity: parity, rs: rs, groups: make(map[uint32]*fecGroup)}, nil
+}
+
+// fecHeader - the header for shard index of group, followed by room for n bytes
+func fecHeader(group uint32, index, n int) []byte {
+	b := make([]byte, fecHeaderLen, fecHeaderLen+n)
+	binary.BigEndian.PutUint32(b, group)
+	b[4] = byte(index)
+	return b
+}
+
+// encode - returns the shard carrying a kcp packet, followed by the group's parity shards if it is the last of its group
+func (f *fec) encode(packet []byte) [][]byte {
+	shard := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(shard, uint16(len(packet)))
+	shard = append(shard, packet...)
+	out := [][]byte{append(fecHeader(f.group, len(f.shards), len(shard)), shard...)}
+
+	f.shards = append(f.shards, shard)
+	f.sent = time.Now()
+	if len(f.shards) < f.data {
+		return out
+	}
+	return append(out, f.flush()...)
+}
+
+// flushIdle - the parity shards of a group nothing has joined for fecFlushDelay, if there is one
+func (f *fec) flushIdle(now time.Time) [][]byte {
+	if len(f.shards) == 0 || now.Sub(f.sent) < fecFlushDelay {
+		return nil
+	}
+	return f.flush()
+}
+
+// flush - the parity shards of the group being sent, which ends it, its missing data shards are zeros
+func (f *fec) flush() [][]byte {
+	// pad the data shards to the same length, and make the parity
+	size := 0
+	for _, s := range f.shards {
+		if len(s) > size {
+			size = len(s)
+		}
+	}
+	all := make([][]byte, f.data+f.parity)
+	for i := range all {
+		all[i] = make([]byte, size)
+		if i < len(f.shards) {
+			copy(all[i], f.shards[i])
+		}
+	}
+	var out [][]byte
+	if err := f.rs.Encode(all); err == nil {
+		for i := f.data; i < len(all); i++ {
+			b := append(fecHeader(f.group, i, 1+size), byte(len(f.shards)))
+			out = append(out, append(b, all[i]...))
+		}
+	}
+	f.group++
+	f.shards = f.shards[:0]
+	return out
+}
+
+// decode - returns the kcp packets a shard gives up, its own if it is a data shard,
+// and any rebuilt from the rest of its group, the number rebuilt, or an error if it is malformed
+func (f *fec) decode(b []byte) ([][]byte, int, error) {
+	if len(b) < fecHeaderLen {
+		return nil, 0, errBadShard
+	}
+	group, index := binary.BigEndian.Uint32(b), int(b[4])
+	shard := b[fecHeaderLen:]
+	if index >= f.data+f.parity {
+		return nil, 0, errBadShard
+	}
+
+	var out [][]byte
+	n := f.data // data shards in the group
+	if index < f.data {
+		packet, err := unshard(shard)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, packet)
+	} else {
+		if len(shard) < 1 || shard[0] < 1 || int(shard[0]) > f.data {
+			return nil, 0, errBadShard
+		}
+		n, shard = int(shard[0]), shard[1:]
+	}
+
+	// groups behind the window are gone, data shards still go to kcp
+	if d := int32(f.newest - group); d >= fecWindow {
+		return out, 0, nil
+	} else if d < 0 {
+		f.newest = group
+		for id := range f.groups {
+			if int32(f.newest-id) >= fecWindow {
+				delete(f.groups, id)
+			}
+		}
+	}
+
+	g, ok := f.groups[group]
+	if !ok {
+		g = &fecGroup{shards: make([][]byte, f.data+f.parity)}
+		f.groups[group] = g
+	}
+	if g.done || g.shards[index] != nil {
+		return out, 0, nil
+	}
+	g.shards[index] = append([]byte{}, shard...)
+	g.count++
+	if n < f.data && !g.short { // the data shards never sent are zeros, padded below
+		g.short = true
+		for i := n; i < f.data; i++ {
+			if g.shards[i] == nil {
+				g.shards[i] = []byte{}
+				g.count++
+			}
+		}
+	}
+	if g.count < f.data {
+		return out, 0, nil
+	}
+
+	// enough of the group is here, rebuild what is missing
+	missing := []int{}
+	size := 0
+	for i, s := range g.shards {
+		if i < f.data && s == nil {
+			missing = append(missing, i)
+		} else if i >= f.data && s != nil {
+			size = len(s)
+		}
+	}
+	g.done = true
+	if len(missing) == 0 {
+		g.shards = nil
+		return out, 0, nil
+	}
+	for i, s := range g.shards[:f.data] {
+		if s == nil {
+			continue
+		}
+		if len(s) > size {
+			return out, 0, errBadShard
+		}
+		g.shards[i] = append(s, make([]byte, size-len(s))...)
+	}
+	err := f.rs.ReconstructData(g.shards)
+	rebuilt := g.shards
+	g.shards = nil
+	if err != nil {
+		return out, 0, errBadShard
+	}
+	for _, i := range missing {
+		packet, err := unshard(rebuilt[i])
+		if err != nil {
+			return out, 0, err
+		}
+		out = append(out, packet)
+	}
+	return out, len(missing), nil
+}
+
+// unshard - the kcp packet in a data shard, without its length and any padding
+func unshard(shard []byte) ([]byte, error) {
+	if len(shard) < 2 {
+		return nil, errBadShard
+	}
+	n := int(binary.BigEndian.Uint16(shard))
+	if n > len(shard)-2 {
+		return nil, errBadShard
+	}
+	return shard[2 : 2+n], nil
+}
+
+// fecEncode - the packets to send for a kcp packet, just the packet if f is nil
+func fecEncode(f *fec, packet []byte) [][]byte {
+	if f == nil {
+		return [][]byte{packet}
+	}
+	return f.encode(packet)
+}
+
+// fecDecode - the kcp packets in a received packet, just the packet if f is nil
+func fecDecode(f *fec, b []byte) ([][]byte, int, error) {
+	if f == nil {
+		return [][]byte{b}, 0, nil
+	}
+	return f.decode(b)
+}
+
+// fecProbeValue - the shard counts in the value of a probeFEC
+func fecProbeValue(data, parity int) uint16 {
+	return uint16(data)<<8 | uint16(parity)
+}
+
+// wrapPacket - the segments to send for a kcp packet, with FEC shards and parity if f is set, each sealed if this module seals
+// None are sent for a session that seals but has no keys yet
+func (m *Module) wrapPacket(s *sealer, f *fec, packet []byte) [][]byte {
+	return m.sealSegments(s, fecEncode(f, packet))
+}
+
+// flushPackets - the parity segments of a FEC group left short, sealed like wrapPacket's, called on the kcp clock
+func (m *Module) flushPackets(s *sealer, f *fec) [][]byte {
+	if f == nil {
+		return nil
+	}
+	return m.sealSegments(s, f.flushIdle(time.Now()))
+}
+
+// sealSegments - packets sealed if this module seals, without those it can't seal yet
+func (m *Module) sealSegments(s *sealer, packets [][]byte) [][]byte {
+	var out [][]byte
+	for _, p := range packets {
+		if p = m.sealSegment(s, p); p != nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// unwrapSegment - the kcp packets in a received segment, and how many FEC rebuilt, or an error if it should be dropped
+func (m *Module) unwrapSegment(s *sealer, f *fec, b []byte) ([][]byte, int, error) {
+	packet, err := m.openSegment(s, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fecDecode(f, packet)
+}
+
+// dropStat - the counter for a segment dropped with err
+func dropStat(err error) counter {
+	if err == errBadShard {
+		return statDecodeFailures
+	}
+	return statRejected
+}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/awgh/ratnet/api"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+/*
+**  FRAMING:  RPC FRAMES OF ANY SIZE, OVER KCP MESSAGES OF A SIZE THE PATH CARRIES
+**
+**  Each RemoteCall or RemoteResponse is sent as one frame, prefixed with its length and request ID:
+**
+**     <length uint32><request ID uint32><serialized payload>
+**
+**  and queued in kcp in pieces no larger than the session's largest message. kcp delivers them
+**  whole and in order, so the far end appends each message it receives to the session's
+**  reassembly buffer, and takes frames off the front as they complete. Pieces of two frames never
+**  interleave, a frame is queued under the same lock as the kcp it goes into.
+ */
+
+const (
+	// requestIDLen - every RemoteCall and RemoteResponse inside KCP starts with the request ID
+	requestIDLen = 4
+
+	// frameLenLen - the length prefix in front of every frame
+	frameLenLen = 4
+
+	// maxFrameSize - the largest frame reassembled, beyond this the stream is taken to be corrupt
+	maxFrameSize = 64 << 20
+)
+
+// errFrameSize - a frame length prefix out of range, kcp framing is lost
+var errFrameSize = errors.New("dns rpc frame length out of range")
+
+// frame - prefixes a serialized RemoteCall or RemoteResponse with its length and request ID
+func frame(id uint32, payload []byte) []byte {
+	b := make([]byte, frameLenLen+requestIDLen+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(requestIDLen+len(payload)))
+	binary.BigEndian.PutUint32(b[frameLenLen:], id)
+	copy(b[frameLenLen+requestIDLen:], payload)
+	return b
+}
+
+// unframe - splits a reassembled frame, without its length, into its request ID and serialized payload
+func unframe(b []byte) (uint32, []byte, error) {
+	if len(b) < requestIDLen {
+		return 0, nil, api.ErrInputTooShort
+	}
+	return binary.BigEndian.Uint32(b), b[requestIDLen:], nil
+}
+
+// sendFrame - queues a frame in kcp as messages of at most msgSize bytes, called with the kcp mutex held
+func sendFrame(k *kcp.KCP, id uint32, payload []byte, msgSize int) error {
+	if requestIDLen+len(payload) > maxFrameSize {
+		return errFrameSize
+	}
+	b := frame(id, payload)
+	for len(b) > 0 {
+		n := msgSize
+		if n > len(b) {
+			n = len(b)
+		}
+		if k.Send(b[:n]) < 0 {
+			return errors.New("dns rpc frame piece too large for kcp")
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// reassembler - joins the kcp messages of a session back into frames
+type reassembler struct {
+	buf []byte
+}
+
+// recv - takes every message kcp has, and returns the frames they complete, called with the kcp mutex held
+// After an error the partial frame is dropped, and frames that follow can't be found
+func (r *reassembler) recv(k *kcp.KCP) ([][]byte, error) {
+	for {
+		n := k.PeekSize()
+		if n <= 0 {
+			break
+		}
+		msg := make([]byte, n) // sized to the message, probing can make them bigger
+		if n = k.Recv(msg); n <= 0 {
+			break
+		}
+		r.buf = append(r.buf, msg[:n]...)
+	}
+
+	var frames [][]byte
+	for len(r.buf) >= frameLenLen {
+		size := binary.BigEndian.Uint32(r.buf)
+		if size < requestIDLen || size > maxFrameSize {
+			r.buf = nil
+			return frames, errFrameSize
+		}
+		if uint32(len(r.buf)-frameLenLen) < size {
+			break
+		}
+		frames = append(frames, r.buf[frameLenLen:frameLenLen+size])
+		r.buf = r.buf[frameLenLen+size:]
+	}
+	if len(r.buf) == 0 {
+		r.buf = nil // let go of the frames returned
+	}
+	return frames, nil
+}
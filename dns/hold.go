@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"time"
+)
+
+/*
+**  HELD QUERIES:  THE SERVER'S POOL OF QUERIES WAITING ON DOWNSTREAM DATA
+**
+**  A query that finds nothing to send is held, and joins its session's queue. Each segment kcp
+**  puts out goes straight to the oldest held query, which is answered with it and whatever else is
+**  ready, while the newer ones go on waiting. A held query is answered empty after HoldTimeout,
+**  before resolvers give up on it, or as soon as maxHeldPerSession newer ones are waiting behind it.
+**  The client keeps Polls queries in flight, so there is nearly always one to answer with. A query
+**  carrying data is only held if none are waiting already, otherwise it is answered at once, so
+**  pipelined data queries don't sit out HoldTimeout while the polls wait for what's coming.
+ */
+
+const (
+	// maxHeldPerSession - queries held for one session, beyond this the oldest is answered empty
+	maxHeldPerSession = 16
+
+	// defaultPolls - polls each client session keeps in flight, unless configured otherwise
+	defaultPolls = 3
+)
+
+// heldQuery - a query waiting on downstream data, gets one segment, or nil to be answered empty
+type heldQuery chan []byte
+
+// holdOrTake - returns a segment if one is ready, otherwise queues a held query for the next one
+// A data query is not held behind others, and gets neither
+func (s *session) holdOrTake(data bool) ([]byte, heldQuery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case item := <-s.downstream:
+		return item, nil
+	default:
+	}
+	if data && len(s.waiting) > 0 {
+		return nil, nil
+	}
+	if len(s.waiting) >= maxHeldPerSession {
+		s.waiting[0] <- nil
+		s.waiting = s.waiting[1:]
+	}
+	q := make(heldQuery, 1)
+	s.waiting = append(s.waiting, q)
+	return nil, q
+}
+
+// deliver - hands a segment to the oldest held query, returns false if none is waiting
+// Called from the kcp output callback, with mutex held
+func (s *session) deliver(segment []byte) bool {
+	if len(s.waiting) == 0 {
+		return false
+	}
+	s.waiting[0] <- segment
+	s.waiting = s.waiting[1:]
+	return true
+}
+
+// queue - hands a segment to the oldest held query, or queues it for the next one
+// Called with mutex held, a segment that doesn't fit is dropped, the client stopped polling and kcp will resend
+func (s *session) queue(segment []byte) {
+	if s.deliver(segment) {
+		return
+	}
+	select {
+	case s.downstream <- segment:
+	default:
+	}
+}
+
+// unhold - takes a held query out of the queue, returns false if it was already given its answer
+func (s *session) unhold(q heldQuery) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, w := range s.waiting {
+		if w == q {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// awaitDownstream - the first segment for a query, waiting up to HoldTimeout for one, nil if none came
+// Past MaxHeldQueries, or for data while other queries are held, only a segment that is ready now
+func (m *Module) awaitDownstream(s *session, data bool, hit func()) []byte {
+	if !m.holdQuery() {
+		hit()
+		select {
+		case item := <-s.downstream:
+			return item
+		default:
+			return nil
+		}
+	}
+	defer m.releaseQuery()
+
+	item, q := s.holdOrTake(data)
+	if q == nil {
+		return item
+	}
+	timer := time.NewTimer(m.HoldTimeout)
+	defer timer.Stop()
+	select {
+	case item = <-q:
+		return item
+	case <-timer.C:
+		if s.unhold(q) {
+			return nil // nothing's ready to go, send empty response
+		}
+		return <-q // handed a segment just as time ran out
+	}
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  LIMITS:  HOW MUCH WORK THE SERVER DOES FOR ANY ONE SENDER
+**
+**  Queries over MaxQuerySize, or over SourceQPS from one address or SessionQPS for one session,
+**  are refused or dropped as LimitAction says. SourceQPS keeps track of at most MaxSources
+**  addresses, forgetting those that have gone quiet to make room, and treats a query from a new
+**  one as over the limit while the rest are all busy. Past MaxHeldQueries, queries waiting on
+**  downstream data are answered empty at once instead of being held. Hits are counted in Stats,
+**  and reported as events at most once per limitReportInterval for each limit.
+ */
+
+// LimitAction values
+const (
+	LimitRefuse = "refuse" // answer queries over a limit with REFUSED
+	LimitDrop   = "drop"   // don't answer queries over a limit at all
+)
+
+const (
+	defaultSourceQPS      = 500
+	defaultSessionQPS     = 100
+	defaultMaxSources     = 10000
+	defaultMaxHeldQueries = 1000
+	defaultMaxQuerySize   = defaultEDNSSize // room for a size probe padded out to the largest answer and signed, see probe.go
+)
+
+var (
+	// limitReportInterval - the least time between events for hits on the same limit
+	limitReportInterval = 10 * time.Second
+
+	// limitPruneInterval - how often idle rate limit buckets are forgotten
+	limitPruneInterval = time.Minute
+)
+
+// the limits, for reporting
+const (
+	limitSize = iota
+	limitSource
+	limitSession
+	limitHeld
+	numLimits
+)
+
+var limitNames = [numLimits]string{"MaxQuerySize", "SourceQPS", "SessionQPS", "MaxHeldQueries"}
+
+// bucket - a token bucket allowing rate events a second, with bursts of up to a second's worth, or one
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take - returns true if there is a token for an event now, and uses it
+func (b *bucket) take(now time.Time, rate float64) bool {
+	burst := math.Max(rate, 1)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limits - the server's rate limit state
+type limits struct {
+	mutex     sync.Mutex // guards sources and lastPrune
+	sources   map[string]*bucket
+	lastPrune time.Time
+
+	held     int32             // queries waiting on downstream data, atomic
+	hits     [numLimits]uint64 // since the last report, atomic
+	reported [numLimits]int64  // unix nanoseconds of the last report, atomic
+}
+
+// allowSource - returns true if a query from addr is within SourceQPS, and MaxSources if addr is new
+func (m *Module) allowSource(addr net.Addr) bool {
+	if m.SourceQPS <= 0 {
+		return true
+	}
+	key := addr.String()
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	now := time.Now()
+
+	l := &m.limits
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.sources == nil {
+		l.sources = make(map[string]*bucket)
+	}
+	b, ok := l.sources[key]
+	if !ok {
+		if m.MaxSources > 0 && len(l.sources) >= m.MaxSources && l.prune(now) >= m.MaxSources {
+			return false
+		}
+		b = new(bucket)
+		l.sources[key] = b
+	}
+	return b.take(now, m.SourceQPS)
+}
+
+// allowSession - returns true if a query for session s is within SessionQPS
+func (m *Module) allowSession(s *session) bool {
+	if m.SessionQPS <= 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rate.take(time.Now(), m.SessionQPS)
+}
+
+// holdQuery - returns true if one more query can wait on downstream data, call releaseQuery when it's done
+func (m *Module) holdQuery() bool {
+	if n := atomic.AddInt32(&m.limits.held, 1); m.MaxHeldQueries > 0 && int(n) > m.MaxHeldQueries {
+		atomic.AddInt32(&m.limits.held, -1)
+		return false
+	}
+	return true
+}
+
+func (m *Module) releaseQuery() {
+	atomic.AddInt32(&m.limits.held, -1)
+}
+
+// pruneLimits - forgets sources that have been quiet long enough to have a full bucket, called from the server clock
+func (m *Module) pruneLimits() {
+	l := &m.limits
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastPrune) < limitPruneInterval {
+		return
+	}
+	l.prune(now)
+}
+
+// prune - forgets sources quiet long enough to have a full bucket, a new one is no different, returns how many are left
+// Called with mutex held
+func (l *limits) prune(now time.Time) int {
+	l.lastPrune = now
+	for key, b := range l.sources {
+		if now.Sub(b.last) > time.Second {
+			delete(l.sources, key)
+		}
+	}
+	return len(l.sources)
+}
+
+// limitHit - counts a query over a limit, and reports it if this limit hasn't been reported lately
+func (m *Module) limitHit(limit int, s *session, from net.Addr) {
+	m.count(s.stats(), statLimited, 1)
+	atomic.AddUint64(&m.limits.hits[limit], 1)
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&m.limits.reported[limit])
+	if now-last < int64(limitReportInterval) || !atomic.CompareAndSwapInt64(&m.limits.reported[limit], last, now) {
+		return
+	}
+	hits := atomic.SwapUint64(&m.limits.hits[limit], 0)
+	events.Warning(m.node, fmt.Sprintf("dns server over %s: %d queries limited, latest from %v", limitNames[limit], hits, from))
+}
+
+// refuseOverLimit - answers a query over a limit as LimitAction says
+func (m *Module) refuseOverLimit(w mdns.ResponseWriter, req *mdns.Msg) {
+	if m.LimitAction == LimitDrop {
+		return
+	}
+	msg := new(mdns.Msg)
+	msg.SetRcode(req, mdns.RcodeRefused)
+	w.WriteMsg(msg)
+}
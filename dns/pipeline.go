@@ -0,0 +1,301 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  PIPELINING:  MANY UPSTREAM DATA QUERIES IN FLIGHT AT ONCE
+**
+**  With MaxInFlight set, a client session sends kcp data as soon as it is queued, without waiting
+**  on the answer to its last query. Queries over UDP share one socket per upstream address, and
+**  answers are matched to them by transaction ID as they arrive, DoH and DoT queries each get an
+**  exchange of their own. The window of queries in flight grows by one for every window's worth
+**  of answers, and is halved for every query lost or failed by the resolver, staying between 1 and MaxInFlight.
+**  Polls still go out from the poll loops, one at a time each.
+ */
+
+const (
+	// defaultMaxInFlight - the largest window of pipelined queries, unless configured otherwise
+	defaultMaxInFlight = 16
+
+	// initialWindow - the window a client session starts with
+	initialWindow = 2
+)
+
+var (
+	// pumpIdle - how long the pipeline waits for data or a free slot before checking the client is still running
+	pumpIdle = 50 * time.Millisecond
+
+	errQueryTimeout = errors.New("dns query timed out")
+)
+
+// flightWindow - how many pipelined queries a client session may have in flight
+type flightWindow struct {
+	mutex    sync.Mutex
+	size     float64
+	inFlight int
+	freed    chan struct{} // signalled when a slot comes free
+}
+
+func newFlightWindow() *flightWindow {
+	return &flightWindow{size: initialWindow, freed: make(chan struct{}, 1)}
+}
+
+// acquire - takes a slot and returns true if fewer than the window are in flight
+func (w *flightWindow) acquire(max int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.size > float64(max) {
+		w.size = float64(max)
+	}
+	if w.inFlight >= int(w.size) {
+		return false
+	}
+	w.inFlight++
+	return true
+}
+
+// release - gives back a slot, halving the window if its query was lost, growing it otherwise
+func (w *flightWindow) release(lost bool, max int) {
+	w.mutex.Lock()
+	w.inFlight--
+	if lost {
+		if w.size /= 2; w.size < 1 {
+			w.size = 1
+		}
+	} else if w.size += 1 / w.size; w.size > float64(max) {
+		w.size = float64(max)
+	}
+	w.mutex.Unlock()
+	w.signal()
+}
+
+// cancel - gives back a slot that wasn't used
+func (w *flightWindow) cancel() {
+	w.mutex.Lock()
+	w.inFlight--
+	w.mutex.Unlock()
+	w.signal()
+}
+
+func (w *flightWindow) signal() {
+	select {
+	case w.freed <- struct{}{}:
+	default:
+	}
+}
+
+// current - the size of the window
+func (w *flightWindow) current() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return int(w.size)
+}
+
+// pumpUpstream - sends queued kcp data as fast as the window allows, until the client stops
+func (m *Module) pumpUpstream(client *clientSession) {
+	for client.IsRunning() && !client.isLost() {
+		if !client.window.acquire(m.MaxInFlight) {
+			select {
+			case <-client.window.freed:
+			case <-time.After(pumpIdle):
+			}
+			continue
+		}
+		select {
+		case buf := <-client.upstreamKCPData:
+			m.sendPipelined(client, buf)
+		case <-time.After(pumpIdle):
+			client.window.cancel()
+		}
+	}
+	events.Info(m.node, "pumpUpstream Loop Stopped")
+}
+
+// sendPipelined - sends a query carrying buf without waiting for its answer, which goes to kcp when it comes
+func (m *Module) sendPipelined(client *clientSession, buf []byte) {
+	req := m.upstreamQuery(client, buf)
+	if req == nil {
+		client.window.cancel()
+		return
+	}
+	m.pipeQuery(client, buf, req, m.pickResolver(client.host), true)
+}
+
+// pipeQuery - sends a pipelined query to addr, and if resend is set and addr leaves it unanswered,
+// once more to the next resolver in the pool, keeping its place in the window
+func (m *Module) pipeQuery(client *clientSession, buf []byte, req *mdns.Msg, addr string, resend bool) {
+	start := time.Now()
+	done := func(r *mdns.Msg, err error) {
+		if err == nil && r.Truncated && !isDoH(addr) && !isDoT(addr) {
+			r, err = m.exchangeTCP(addr, req)
+		}
+		ok := answered(r, err)
+		m.reportResolver(addr, ok, time.Since(start))
+		if !ok && resend && !errors.Is(err, ErrTSIG) && client.IsRunning() {
+			if next := m.nextResolver(addr); next != "" {
+				events.Info(m.node, "dns query unanswered by "+addr+", sending it to "+next)
+				m.pipeQuery(client, buf, req, next, false)
+				return
+			}
+		}
+		client.window.release(!ok, m.MaxInFlight)
+		m.takeResponse(client, buf, r, err)
+	}
+
+	if isDoH(addr) || isDoT(addr) {
+		go func() { done(m.send(addr, req)) }()
+		return
+	}
+	p, err := client.pipe(m, addr)
+	if err != nil {
+		go done(nil, err)
+		return
+	}
+	m.throttle()
+	p.send(m.signQuery(req), m.tsigSecrets(), done)
+}
+
+// pipe - the client's UDP pipe to addr, opening it if needed
+func (c *clientSession) pipe(m *Module, addr string) (*udpPipe, error) {
+	c.pipeMutex.Lock()
+	defer c.pipeMutex.Unlock()
+	if p, ok := c.pipes[addr]; ok {
+		return p, nil
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &udpPipe{conn: conn, pending: make(map[uint16]*pipedQuery)}
+	if c.pipes == nil {
+		c.pipes = make(map[string]*udpPipe)
+	}
+	c.pipes[addr] = p
+	go p.read(m)
+	return p, nil
+}
+
+// closePipes - closes every UDP pipe, failing the queries still in flight on them
+func (c *clientSession) closePipes() {
+	c.pipeMutex.Lock()
+	pipes := c.pipes
+	c.pipes = nil
+	c.pipeMutex.Unlock()
+	for _, p := range pipes {
+		p.close()
+	}
+}
+
+// pipedQuery - a query in flight on a pipe
+type pipedQuery struct {
+	done func(*mdns.Msg, error)
+	mac  string // its TSIG MAC, which signs the answer, when signed
+}
+
+// udpPipe - a UDP socket to one upstream address, with any number of queries in flight on it
+// Signs and verifies TSIG itself, since an mdns.Conn only remembers the MAC of its last query
+type udpPipe struct {
+	conn    net.Conn
+	mutex   sync.Mutex
+	pending map[uint16]*pipedQuery // by transaction ID, nil once closed
+}
+
+// send - sends a query signed with secrets, done gets its answer or an error, never on this goroutine
+func (p *udpPipe) send(req *mdns.Msg, secrets map[string]string, done func(*mdns.Msg, error)) {
+	p.mutex.Lock()
+	if p.pending == nil {
+		p.mutex.Unlock()
+		go done(nil, ErrStopped)
+		return
+	}
+	for _, taken := p.pending[req.Id]; taken; _, taken = p.pending[req.Id] {
+		req.Id = mdns.Id()
+	}
+	q := &pipedQuery{done: done}
+	var out []byte
+	var err error
+	if t := req.IsTsig(); t != nil {
+		out, q.mac, err = mdns.TsigGenerate(req, secrets[t.Hdr.Name], "", false)
+	} else {
+		out, err = req.Pack()
+	}
+	if err != nil {
+		p.mutex.Unlock()
+		go done(nil, err)
+		return
+	}
+	id := req.Id
+	p.pending[id] = q
+	p.mutex.Unlock()
+
+	time.AfterFunc(clientTimeout, func() { p.finish(id, nil, errQueryTimeout) })
+	if _, err := p.conn.Write(out); err != nil {
+		p.finish(id, nil, err)
+	}
+}
+
+// finish - hands an answer or an error to the query with this ID, if it is still waiting
+func (p *udpPipe) finish(id uint16, r *mdns.Msg, err error) {
+	p.mutex.Lock()
+	q, ok := p.pending[id]
+	delete(p.pending, id)
+	p.mutex.Unlock()
+	if ok {
+		go q.done(r, err)
+	}
+}
+
+// read - matches answers to queries by transaction ID until the pipe is closed
+func (p *udpPipe) read(m *Module) {
+	secrets := m.tsigSecrets()
+	buf := make([]byte, mdns.MaxMsgSize)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			p.mutex.Lock()
+			closed := p.pending == nil
+			p.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue // an ICMP error belongs to no query in particular, they time out instead
+		}
+		r := new(mdns.Msg)
+		if r.Unpack(buf[:n]) != nil {
+			continue
+		}
+		id := r.Id
+		p.mutex.Lock()
+		q, ok := p.pending[id]
+		p.mutex.Unlock()
+		if !ok {
+			continue // late, or not ours
+		}
+		if t := r.IsTsig(); t != nil && secrets != nil {
+			err = mdns.TsigVerify(buf[:n], secrets[t.Hdr.Name], q.mac, false)
+		}
+		r, err = m.checkResponse(r, err)
+		p.finish(id, r, err)
+	}
+}
+
+// close - closes the socket, failing every query still in flight
+func (p *udpPipe) close() {
+	p.mutex.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mutex.Unlock()
+	p.conn.Close()
+	for _, q := range pending {
+		go q.done(nil, ErrStopped)
+	}
+}
@@ -0,0 +1,467 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	mdns "github.com/miekg/dns"
+	kcp "github.com/xtaci/kcp-go"
+
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  PROBES:  MEASURING THE PATH WHEN A CLIENT SESSION STARTS
+**
+**  Probe queries carry data outside of kcp, starting with an operation and a 16-bit value:
+**
+**     <op><value><padding>
+**
+**  The client picks the densest name codec that arrives intact, the longest query name
+**  and the largest response that make it through, then tells the server its downstream mtu.
+**  Last it opens the session, the server answers data and polls for any other with NXDOMAIN.
+**
+**  Over UDP, the server answers a size probe with no more answer bytes than the query had, so
+**  clients pad size probes out with EDNS0 padding. A resolver on the path sends queries of its
+**  own without the padding, so through one the largest response found is about a full query name.
+ */
+
+// probe operations, the first byte of a probe query's data
+const (
+	probeEcho  = 'e' // answer with a digest of the data, to check the query name arrived intact
+	probeSize  = 's' // answer with a segment of value bytes, to check a response that size arrives intact
+	probeMTU   = 'm' // set the session's downstream mtu to value
+	probeKey   = 'k' // answer with the server's public key, for clients that don't have it
+	probeHello = 'h' // key the session, see seal.go
+	probeFEC   = 'f' // turn on FEC for the session, data shards in the high byte of value and parity in the low, see fec.go
+	probeOpen  = 'o' // start the session, data and polls for a session not started are answered NXDOMAIN
+	probeZip   = 'z' // compress the session's RPC frames, value is the highest compression flag the client reads, see compress.go
+)
+
+const (
+	// probeHeaderLen - the operation and value at the start of probe data
+	probeHeaderLen = 3
+
+	// minMTU - the smallest mtu kcp accepts
+	minMTU = 50
+
+	// maxProbeMTU - the largest downstream mtu a client asks for
+	maxProbeMTU = 1200
+
+	// probeTries - probes that change the session are sent this many times before giving up,
+	// the server answers a repeated one the same way
+	probeTries = 3
+)
+
+var (
+	// errBadProbe - returned for probe data that isn't a known operation, or a probe the server refused
+	errBadProbe = errors.New("bad probe query")
+
+	// errNoAnswer - a probe got no response, the host may be down or unreachable for now
+	errNoAnswer = errors.New("no answer to probe")
+)
+
+// codecProbe - padding for the codec probe, with letters in both cases to catch case randomization
+// and bytes that need escaping, to catch paths that don't preserve 8-bit labels
+var codecProbe = []byte("0x20 Probe: AbCdEfGhIjKlMnOpQrStUvWxYz \x00.\\\"\xff")
+
+// probeDigest - the answer to a probeEcho
+func probeDigest(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:16]
+}
+
+// probeFill - the answer to a probeSize, n bytes that depend on all of the probe data, so no cache has seen them
+func probeFill(data []byte, n int) []byte {
+	b := make([]byte, 0, n+sha256.Size)
+	sum := sha256.Sum256(data)
+	for len(b) < n {
+		b = append(b, sum[:]...)
+		sum = sha256.Sum256(sum[:])
+	}
+	return b[:n]
+}
+
+// answerProbe - the server's answer to the probe data from session id, most is the largest size probe it answers
+func (m *Module) answerProbe(id uint32, data []byte, most int) ([][]byte, error) {
+	if len(data) < probeHeaderLen {
+		return nil, errBadProbe
+	}
+	value := int(binary.BigEndian.Uint16(data[1:]))
+	switch data[0] {
+	case probeEcho:
+		return [][]byte{probeDigest(data)}, nil
+	case probeSize:
+		if value < minMTU || value > maxProbeMTU || value > most {
+			return nil, errBadProbe
+		}
+		return [][]byte{probeFill(data, value)}, nil
+	case probeMTU:
+		if value < minMTU+m.sealOverhead() || value > maxProbeMTU {
+			return nil, errBadProbe
+		}
+		s := m.getSession(id)
+		if m.Encrypt && s.keyed() {
+			return nil, errBadProbe // only before the handshake, so no one else can change it
+		}
+		s.setMTU(value, m.sealOverhead())
+		return [][]byte{probeDigest(data)}, nil
+	case probeFEC:
+		f, err := newFEC(value>>8, value&0xff)
+		if err != nil {
+			return nil, errBadProbe
+		}
+		s := m.getSession(id)
+		if m.Encrypt && s.keyed() {
+			return nil, errBadProbe // only before the handshake, like the mtu
+		}
+		if !s.setFEC(f, m.sealOverhead()) {
+			return nil, errBadProbe
+		}
+		return [][]byte{probeDigest(data)}, nil
+	case probeOpen:
+		m.getSession(id)
+		s := m.liveSession(id)
+		if s == nil {
+			return nil, errBadProbe // only after the handshake, if this module seals
+		}
+		if m.listener != nil {
+			m.listener.offer(m, s)
+		}
+		return [][]byte{probeDigest(data)}, nil
+	case probeZip:
+		if !m.Compress || value < compressDeflate {
+			return nil, errBadProbe
+		}
+		s := m.getSession(id)
+		if m.Encrypt && s.keyed() {
+			return nil, errBadProbe // only before the handshake, like the mtu
+		}
+		s.mutex.Lock()
+		s.compress = true
+		s.mutex.Unlock()
+		return [][]byte{probeDigest(data)}, nil
+	case probeKey:
+		if !m.Encrypt {
+			return nil, errBadProbe
+		}
+		_, pub, err := m.handshakeKey()
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{pub}, nil
+	case probeHello:
+		answer, err := m.answerHello(id, data[probeHeaderLen:])
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{answer}, nil
+	}
+	return nil, errBadProbe
+}
+
+// probePath - sets up a new client session for the path to its host, and keys it if this module seals
+// Gives up with ctx's error when it is done, no probe waits past its deadline
+func (m *Module) probePath(ctx context.Context, client *clientSession) error {
+	m.negotiateCodec(ctx, client)
+
+	up, down := m.upstreamMTU(client.codec), mtu
+	if m.ProbeMTU {
+		if n := m.probeUpstreamMTU(ctx, client); n > 0 {
+			up = n
+		}
+		if n := m.probeDownstreamMTU(ctx, client); n > 0 && m.probeSetMTU(ctx, client, n) {
+			down = n
+		}
+		events.Info(m.node, "dns client for "+client.host+" probed mtu up/down:", up, down)
+	}
+	if err := ctx.Err(); err != nil { // the failed probes measured nothing
+		return err
+	}
+
+	if m.ParityShards > 0 {
+		if err := m.negotiateFEC(ctx, client); err != nil {
+			return err
+		}
+	}
+	if m.Compress {
+		if err := m.negotiateCompression(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	// last, so the session's mtu, FEC and compression can't be changed once it has keys
+	if m.Encrypt {
+		if err := m.handshake(ctx, client); err != nil {
+			return err
+		}
+	}
+	if err := m.openSession(ctx, client); err != nil {
+		return err
+	}
+
+	overhead := m.sealOverhead()
+	if client.fec != nil {
+		overhead += fecOverhead
+	}
+	client.mutex.Lock()
+	client.kcp.SetMtu(up - overhead)
+	client.mutex.Unlock()
+
+	client.maxMsgSize = msgSizeFor(up, overhead)
+	if n := msgSizeFor(down, overhead); n < client.maxMsgSize {
+		client.maxMsgSize = n
+	}
+	m.probedByteLimit(int64(client.maxMsgSize - (maxMsgSize - defaultByteLimit)))
+	client.probed = true
+	return nil
+}
+
+// msgSizeFor - the largest message that goes through reliably at this mtu, scaled from the
+// last known good at the default mtu, and never more fragments than fit in a kcp window
+func msgSizeFor(n, overhead int) int {
+	size := maxMsgSize * (n - kcp.IKCP_OVERHEAD) / (mtu - kcp.IKCP_OVERHEAD)
+	if most := (kcp.IKCP_WND_RCV - 1) * (n - overhead - kcp.IKCP_OVERHEAD); size > most {
+		size = most
+	}
+	return size
+}
+
+// negotiateFEC - asks the server to use FEC with DataShards and ParityShards, and uses it too if the server agrees
+// Returns errNoAnswer if the server never answers, or ctx's error, it may have agreed, so the session starts over rather than go without
+func (m *Module) negotiateFEC(ctx context.Context, client *clientSession) error {
+	f, err := newFEC(m.DataShards, m.ParityShards)
+	if err != nil {
+		events.Warning(m.node, err.Error())
+		return nil
+	}
+	data := make([]byte, probeHeaderLen+8)
+	data[0] = probeFEC
+	binary.BigEndian.PutUint16(data[1:], fecProbeValue(m.DataShards, m.ParityShards))
+	rand.Read(data[probeHeaderLen:])
+	answer, err := m.retryProbe(ctx, client, data)
+	if unanswered(err) {
+		return err
+	} else if err != nil || !bytes.Equal(answer, probeDigest(data)) {
+		events.Warning(m.node, "dns client for "+client.host+" going without FEC, the server refused it")
+		return nil
+	}
+	client.mutex.Lock()
+	client.fec = f
+	client.mutex.Unlock()
+	events.Info(m.node, fmt.Sprintf("dns client for %s using FEC with %d data and %d parity shards", client.host, m.DataShards, m.ParityShards))
+	return nil
+}
+
+// openSession - tells the server the session has started, a stream server only offers it to Accept then
+// Returns errNoAnswer if the server never answers, like negotiateFEC
+func (m *Module) openSession(ctx context.Context, client *clientSession) error {
+	data := make([]byte, probeHeaderLen+8)
+	data[0] = probeOpen
+	rand.Read(data[probeHeaderLen:])
+	if _, err := m.retryProbe(ctx, client, data); unanswered(err) {
+		return err
+	}
+	return nil
+}
+
+// negotiateCompression - asks the server to compress the session's RPC frames, and compresses them too if it agrees
+// Returns errNoAnswer if the server never answers, like negotiateFEC
+func (m *Module) negotiateCompression(ctx context.Context, client *clientSession) error {
+	data := make([]byte, probeHeaderLen+8)
+	data[0] = probeZip
+	binary.BigEndian.PutUint16(data[1:], compressDeflate)
+	rand.Read(data[probeHeaderLen:])
+	answer, err := m.retryProbe(ctx, client, data)
+	if unanswered(err) {
+		return err
+	} else if err != nil || !bytes.Equal(answer, probeDigest(data)) {
+		events.Warning(m.node, "dns client for "+client.host+" going without compression, the server refused it")
+		return nil
+	}
+	client.compress = true
+	events.Info(m.node, "dns client for "+client.host+" compressing RPC frames")
+	return nil
+}
+
+// negotiateCodec - picks the first of Alphabets that survives a round trip to the server, or base32
+func (m *Module) negotiateCodec(ctx context.Context, client *clientSession) {
+	client.codec = base32Codec
+	for _, name := range m.Alphabets {
+		codec, err := NameCodecByName(name)
+		if err != nil {
+			events.Warning(m.node, err.Error())
+			continue
+		}
+		if codec == base32Codec || m.probeEcho(ctx, client, codec, codecProbe) {
+			client.codec = codec
+			break
+		}
+	}
+	events.Info(m.node, "dns client for "+client.host+" using name codec "+client.codec.Name())
+}
+
+// probeUpstreamMTU - the longest kcp packet that arrives intact in a query name, or zero
+func (m *Module) probeUpstreamMTU(ctx context.Context, client *clientSession) int {
+	hi := maxDotifyLen(client.codec, querySuffix(queryProbe, client.codec, client.id, m.zone()))
+	return searchMTU(minMTU+m.sealOverhead(), hi, func(n int) bool {
+		padding := make([]byte, n-probeHeaderLen)
+		rand.Read(padding)
+		return m.probeEcho(ctx, client, client.codec, padding)
+	})
+}
+
+// probeDownstreamMTU - the largest kcp packet that arrives intact in a response, or zero
+func (m *Module) probeDownstreamMTU(ctx context.Context, client *clientSession) int {
+	enc := m.recordEncoder()
+
+	// leave room for the header, the longest question name and an OPT record
+	limit := mdns.MinMsgSize
+	if m.streamUpstream(client.host) {
+		limit = mdns.MaxMsgSize
+	} else if m.EDNSSize > 0 {
+		limit = int(m.EDNSSize)
+	}
+	limit -= 12 + 255 + 4 + 11
+
+	hi := maxProbeMTU
+	for hi >= minMTU {
+		if enc.Size(hi) <= limit {
+			if _, err := enc.Encode(scrubName, [][]byte{make([]byte, hi)}); err == nil {
+				break
+			}
+		}
+		hi--
+	}
+	if hi < minMTU {
+		return 0
+	}
+
+	return searchMTU(minMTU+m.sealOverhead(), hi, func(n int) bool {
+		data := make([]byte, probeHeaderLen+8)
+		data[0] = probeSize
+		binary.BigEndian.PutUint16(data[1:], uint16(n))
+		rand.Read(data[probeHeaderLen:])
+		answer, ok := m.probe(ctx, client, client.codec, data)
+		return ok && bytes.Equal(answer, probeFill(data, n))
+	})
+}
+
+// probeSetMTU - tells the server the downstream mtu for this session, returns true if it agreed
+func (m *Module) probeSetMTU(ctx context.Context, client *clientSession, n int) bool {
+	data := make([]byte, probeHeaderLen+8)
+	data[0] = probeMTU
+	binary.BigEndian.PutUint16(data[1:], uint16(n))
+	rand.Read(data[probeHeaderLen:])
+	answer, ok := m.probe(ctx, client, client.codec, data)
+	return ok && bytes.Equal(answer, probeDigest(data))
+}
+
+// probeEcho - returns true if padding spelled with codec makes it to the server intact
+func (m *Module) probeEcho(ctx context.Context, client *clientSession, codec NameCodec, padding []byte) bool {
+	data := append([]byte{probeEcho, 0, 0}, padding...)
+	answer, ok := m.probe(ctx, client, codec, data)
+	return ok && bytes.Equal(answer, probeDigest(data))
+}
+
+// probe - sends probe data spelled with codec, and returns the single segment answer if there was one
+// Truncated answers count as failures, the point is to find what fits without falling back to TCP
+func (m *Module) probe(ctx context.Context, client *clientSession, codec NameCodec, data []byte) ([]byte, bool) {
+	answer, err := m.probeAnswer(ctx, client, codec, data)
+	return answer, err == nil
+}
+
+// retryProbe - sends a probe until it is answered or refused, errNoAnswer if it never is
+func (m *Module) retryProbe(ctx context.Context, client *clientSession, data []byte) (answer []byte, err error) {
+	for i := 0; i < probeTries; i++ {
+		if answer, err = m.probeAnswer(ctx, client, client.codec, data); err != errNoAnswer {
+			return
+		}
+	}
+	return
+}
+
+// unanswered - true for an error from a probe that may have reached the server, but got no answer back
+func unanswered(err error) bool {
+	return err == errNoAnswer || err == context.DeadlineExceeded || err == context.Canceled
+}
+
+// probeAnswer - like probe, but tells a probe nobody answered, errNoAnswer, from one the server refused
+// Returns ctx's error once it is done, the exchange waits no longer than its deadline
+func (m *Module) probeAnswer(ctx context.Context, client *clientSession, codec NameCodec, data []byte) ([]byte, error) {
+	select {
+	case <-client.done:
+		return nil, ErrStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	name, err := DotifyCodec(data, querySuffix(queryProbe, codec, client.id, m.zone()), codec)
+	if err != nil {
+		return nil, err
+	}
+	enc := m.recordEncoder()
+	req := new(mdns.Msg)
+	req.SetQuestion(name, enc.Type())
+	req.RecursionDesired = true
+	if m.EDNSSize > 0 {
+		req.SetEdns0(m.EDNSSize, false)
+		if data[0] == probeSize {
+			padProbe(req, enc.Size(int(binary.BigEndian.Uint16(data[1:]))))
+		}
+	}
+	m.count(&client.counters, statQueriesSent, 1)
+	m.count(&client.counters, statUpstreamBytes, len(data))
+	r, err := m.exchangeOnce(ctx, client.host, req)
+	if errors.Is(err, ErrTSIG) {
+		m.count(&client.counters, statRejected, 1)
+		return nil, err
+	} else if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil || r.Truncated {
+		return nil, errNoAnswer
+	}
+	m.count(&client.counters, statResponses, 1)
+	segments, err := enc.Decode(r.Answer)
+	if err != nil || len(segments) != 1 {
+		return nil, errBadProbe
+	}
+	m.count(&client.counters, statAnswers, 1)
+	m.count(&client.counters, statDownstreamBytes, len(segments[0]))
+	return segments[0], nil
+}
+
+// padProbe - pads a query with EDNS0 padding to at least n bytes, the answer bytes of the size probe it carries
+func padProbe(req *mdns.Msg, n int) {
+	const optionLen = 4 // the padding option's code and length
+	if pad := n - req.Len() - optionLen; pad > 0 {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &mdns.EDNS0_PADDING{Padding: make([]byte, pad)})
+	}
+}
+
+// searchMTU - the largest n from lo to hi that fits, or zero, trying hi first since it usually does
+func searchMTU(lo, hi int, fits func(n int) bool) int {
+	if hi < lo {
+		return 0
+	}
+	if fits(hi) {
+		return hi
+	}
+	best := 0
+	for hi--; lo <= hi; {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best
+}
@@ -0,0 +1,270 @@
+package dns
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  RESOLVER POOL:  SPREADING CLIENT QUERIES OVER SEVERAL RESOLVERS
+**
+**  With Resolvers set, the queries of every client session go to the resolvers in turn instead of
+**  to the session's host, or with ResolverPolicy weighted, to one picked at random in proportion to
+**  how often it answers and how fast. A resolver failing ResolverFailures times in a row is taken
+**  out of the pool, and once every ResolverRetry it is sent a query of its own, going back in when
+**  one is answered. While every resolver is out, queries go to all of them in turn rather than
+**  to none. A query one resolver leaves unanswered is sent once more, to the next one that is up.
+**
+**  The pool belongs to the module, every client session uses it whatever its host.
+ */
+
+// ResolverPolicy values
+const (
+	PolicyRoundRobin = "roundrobin" // each query to the next resolver in the pool
+	PolicyWeighted   = "weighted"   // each query to a resolver picked by its score and round trip time
+)
+
+const (
+	defaultResolverFailures = 3
+
+	// healthAlpha - the weight of the latest exchange in a resolver's smoothed score and round trip time
+	healthAlpha = 0.2
+)
+
+// defaultResolverRetry - how long a failed resolver is left out before it is tried again, unless configured otherwise
+var defaultResolverRetry = 30 * time.Second
+
+// resolver - the health of one resolver in the pool
+type resolver struct {
+	addr     string
+	score    float64       // smoothed fraction of queries answered, from 0 to 1
+	rtt      time.Duration // smoothed time to an answer
+	failures int           // in a row
+	down     bool
+	retryAt  time.Time // when a resolver that is down gets its next query
+	probing  bool      // that query is in flight
+
+	queries, failed uint64
+}
+
+// resolverPool - the resolvers client queries are spread over, guarded by its mutex
+type resolverPool struct {
+	mutex     sync.Mutex
+	addrs     []string // the Resolvers the pool was made from
+	resolvers []*resolver
+	next      int // round robin position
+}
+
+// sync - remakes the pool if Resolvers has changed, keeping the health of resolvers still in it
+func (p *resolverPool) sync(addrs []string) {
+	if len(addrs) == len(p.addrs) {
+		same := true
+		for i := range addrs {
+			same = same && addrs[i] == p.addrs[i]
+		}
+		if same {
+			return
+		}
+	}
+	resolvers := make([]*resolver, len(addrs))
+	for i, addr := range addrs {
+		if r := p.find(addr); r != nil {
+			resolvers[i] = r
+		} else {
+			resolvers[i] = &resolver{addr: addr, score: 1}
+		}
+	}
+	p.addrs = append([]string{}, addrs...)
+	p.resolvers = resolvers
+}
+
+func (p *resolverPool) find(addr string) *resolver {
+	for _, r := range p.resolvers {
+		if r.addr == addr {
+			return r
+		}
+	}
+	return nil
+}
+
+// weight - how much of the traffic a resolver gets under PolicyWeighted
+func (r *resolver) weight() float64 {
+	rtt := r.rtt
+	if rtt < time.Millisecond {
+		rtt = time.Millisecond
+	}
+	score := r.score
+	if score < 0.01 {
+		score = 0.01
+	}
+	return score / rtt.Seconds()
+}
+
+// pickResolver - where a query for host's session goes, host itself unless Resolvers is set
+// Resolvers out of the pool and due a retry are sent a query of their own in the background
+func (m *Module) pickResolver(host string) string {
+	if len(m.Resolvers) == 0 {
+		return host
+	}
+	p := &m.pool
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sync(m.Resolvers)
+
+	now := time.Now()
+	up := make([]*resolver, 0, len(p.resolvers))
+	for _, r := range p.resolvers {
+		if !r.down {
+			up = append(up, r)
+		} else if !r.probing && !now.Before(r.retryAt) {
+			r.probing = true
+			go m.reprobe(r.addr)
+		}
+	}
+	if len(up) == 0 {
+		up = p.resolvers
+	}
+
+	if m.ResolverPolicy == PolicyWeighted {
+		total := 0.0
+		for _, r := range up {
+			total += r.weight()
+		}
+		x := rand.Float64() * total
+		for _, r := range up {
+			if x -= r.weight(); x < 0 {
+				return r.addr
+			}
+		}
+		return up[len(up)-1].addr
+	}
+	p.next = (p.next + 1) % len(up)
+	return up[p.next].addr
+}
+
+// nextResolver - the first resolver after addr in the pool that is up, to send a query addr left unanswered, or "" if there is none
+func (m *Module) nextResolver(addr string) string {
+	if len(m.Resolvers) < 2 {
+		return ""
+	}
+	p := &m.pool
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, r := range p.resolvers {
+		if r.addr != addr {
+			continue
+		}
+		for j := 1; j < len(p.resolvers); j++ {
+			if next := p.resolvers[(i+j)%len(p.resolvers)]; !next.down {
+				return next.addr
+			}
+		}
+		break
+	}
+	return ""
+}
+
+// answered - true if a resolver got an answer from the far end, a response it failed to get one is no better than none
+func answered(r *mdns.Msg, err error) bool {
+	return err == nil && r.Rcode != mdns.RcodeServerFailure && r.Rcode != mdns.RcodeRefused
+}
+
+// reportResolver - updates the health of resolver addr after an exchange, taking it out of the pool
+// after ResolverFailures in a row and putting it back in when it answers again
+func (m *Module) reportResolver(addr string, ok bool, rtt time.Duration) {
+	if len(m.Resolvers) == 0 {
+		return
+	}
+	p := &m.pool
+	p.mutex.Lock()
+	r := p.find(addr)
+	if r == nil {
+		p.mutex.Unlock()
+		return
+	}
+	r.queries++
+	wentDown, cameBack := false, false
+	if ok {
+		r.score += healthAlpha * (1 - r.score)
+		if r.rtt == 0 {
+			r.rtt = rtt
+		} else {
+			r.rtt += time.Duration(healthAlpha * float64(rtt-r.rtt))
+		}
+		r.failures = 0
+		cameBack, r.down = r.down, false
+	} else {
+		r.failed++
+		r.score -= healthAlpha * r.score
+		r.failures++
+		if !r.down && r.failures >= m.ResolverFailures {
+			r.down, wentDown = true, true
+			r.retryAt = time.Now().Add(m.ResolverRetry)
+		}
+	}
+	failures := r.failures
+	p.mutex.Unlock()
+
+	if wentDown {
+		events.Warning(m.node, fmt.Sprintf("dns resolver %s failed %d times in a row, taking it out of the pool", addr, failures))
+	} else if cameBack {
+		events.Info(m.node, "dns resolver "+addr+" is answering again, back in the pool")
+	}
+}
+
+// reprobe - sends a resolver out of the pool a query for the tunnel domain, or the root in direct mode
+func (m *Module) reprobe(addr string) {
+	name := m.zone()
+	if name == "" {
+		name = "."
+	}
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeNS)
+	m.count(nil, statQueriesSent, 1)
+	start := time.Now()
+	r, err := m.send(addr, req)
+	ok := answered(r, err)
+
+	p := &m.pool
+	p.mutex.Lock()
+	if res := p.find(addr); res != nil {
+		res.probing = false
+		if !ok {
+			res.retryAt = time.Now().Add(m.ResolverRetry)
+		}
+	}
+	p.mutex.Unlock()
+	m.reportResolver(addr, ok, time.Since(start))
+}
+
+// streamUpstream - true if every query for host's session goes over DoH or DoT, so answers aren't limited to a datagram
+func (m *Module) streamUpstream(host string) bool {
+	addrs := m.Resolvers
+	if len(addrs) == 0 {
+		addrs = []string{host}
+	}
+	for _, addr := range addrs {
+		if !isDoH(addr) && !isDoT(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolverStats - the health of every resolver in the pool
+func (m *Module) resolverStats() map[string]ResolverStats {
+	stats := make(map[string]ResolverStats)
+	p := &m.pool
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, r := range p.resolvers {
+		stats[r.addr] = ResolverStats{Up: !r.down, Score: r.score, RTT: r.rtt, Queries: r.queries, Failures: r.failed}
+	}
+	return stats
+}
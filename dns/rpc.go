@@ -1,8 +1,10 @@
 package dns
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
@@ -12,36 +14,130 @@ import (
 //  UPSTREAM
 //
 
-// RPC : transmit data via DNS
+// TimeoutError - returned by RPC when no response arrives before the deadline,
+// as opposed to an error returned by the remote end
+type TimeoutError struct {
+	Host   string
+	Action api.Action
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("dns rpc %d to %s timed out", e.Action, e.Host)
+}
+
+// Timeout - always true, this satisfies net.Error
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary - always true, this satisfies net.Error
+func (e *TimeoutError) Temporary() bool { return true }
+
+// Unwrap - a TimeoutError is a context.DeadlineExceeded
+func (e *TimeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// RPC : transmit data via DNS, giving up after RPCTimeout
 func (m *Module) RPC(host string, method api.Action, args ...interface{}) (interface{}, error) {
+	ctx := context.Background()
+	if m.RPCTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.RPCTimeout)
+		defer cancel()
+	}
+	return m.RPCContext(ctx, host, method, args...)
+}
+
+// RPCContext : transmit data via DNS, giving up when ctx is done
+func (m *Module) RPCContext(ctx context.Context, host string, method api.Action, args ...interface{}) (interface{}, error) {
 	events.Info(m.node, fmt.Sprintf("\n***\n***RPC %d called: %s  client:%x server:%x\n***\n", method, host, m.ClientConv, m.ServerConv))
 
-	if !m.IsRunningClient() {
-		m.UpstreamStr = host
-		m.initClient()
-		m.startClient()
+	if host == "" {
+		host = m.UpstreamStr
+	}
+	if host == "" && len(m.Resolvers) > 0 {
+		host = m.Resolvers[0] // the session is named after the pool, its queries go to all of it
 	}
 
 	var a api.RemoteCall
 	a.Action = method
 	a.Args = args
 
+	// a session the server has forgotten, after sessionTimeout or a restart, is started over and the call sent again
+	value, err := m.call(ctx, host, &a)
+	if err == ErrSessionLost {
+		events.Warning(m.node, fmt.Sprintf("dns RPC %d to %s sent again in a new session", method, host))
+		value, err = m.call(ctx, host, &a)
+	}
+	return value, err
+}
+
+// call - sends a RemoteCall in the client session for host, and waits for its response
+func (m *Module) call(ctx context.Context, host string, a *api.RemoteCall) (interface{}, error) {
+	method := a.Action
+	client, err := m.acquireClient(ctx, host)
+	if err == context.DeadlineExceeded {
+		events.Warning(m.node, fmt.Sprintf("dns RPC %d to %s abandoned: no answer", method, host))
+		return nil, &TimeoutError{Host: host, Action: method}
+	} else if err != nil {
+		events.Error(m.node, err.Error())
+		return nil, err
+	}
+	defer m.releaseClient(client)
+
 	// Note: Chunking happens at the node.Send level, inside ratnet, otherwise Pickup won't work
+	// a call too large for one kcp message goes in several, see sendFrame
 
-	buffer := api.RemoteCallToBytes(&a)
-	if len(*buffer) > 2889 { // lkg: 2889 bytes here
-		events.Warning(m.node, "dns trying to send large buffer: ", len(*buffer))
+	buffer := api.RemoteCallToBytes(a)
+	payload := *buffer
+	if client.compress {
+		payload = m.compressPayload(&client.counters, payload)
 	}
 
-	m.clientMutex.Lock()
-	m.kcpClient.Send(*buffer)
-	m.clientMutex.Unlock()
+	// register for the response before sending, so it can't arrive first
+	id := atomic.AddUint32(&m.requestID, 1)
+	respchan := make(chan api.RemoteResponse, 1)
+	client.pendingMutex.Lock()
+	client.pending[id] = respchan
+	client.pendingMutex.Unlock()
 
-	rr := <-m.respchan
+	client.mutex.Lock()
+	err = sendFrame(client.kcp, id, payload, client.maxMsgSize)
+	client.mutex.Unlock()
+	if err != nil {
+		client.pendingMutex.Lock()
+		delete(client.pending, id)
+		client.pendingMutex.Unlock()
+		return nil, err
+	}
 
-	events.Info(m.node, fmt.Sprintf("\n***\n***RPC %d returned Error: %s, Value: %+v\n***\n", method, rr.Error, rr.Value))
+	var rr api.RemoteResponse
+	select {
+	case rr = <-respchan:
+	case <-client.done:
+		client.pendingMutex.Lock()
+		delete(client.pending, id)
+		client.pendingMutex.Unlock()
+		return nil, ErrStopped
+	case <-client.lost:
+		client.pendingMutex.Lock()
+		delete(client.pending, id)
+		client.pendingMutex.Unlock()
+		return nil, ErrSessionLost
+	case <-ctx.Done():
+		client.pendingMutex.Lock()
+		delete(client.pending, id)
+		client.pendingMutex.Unlock()
 
-	m.stopClient()
+		events.Warning(m.node, fmt.Sprintf("dns RPC %d to %s abandoned: %s", method, host, ctx.Err().Error()))
+		if ctx.Err() != context.DeadlineExceeded {
+			return nil, ctx.Err()
+		}
+		// the far end is gone or unreachable, and our kcp state with it
+		client.lifeMutex.Lock()
+		client.timedOut = true
+		client.lifeMutex.Unlock()
+		return nil, &TimeoutError{Host: host, Action: method}
+	}
+
+	events.Info(m.node, fmt.Sprintf("\n***\n***RPC %d returned Error: %s, Value: %+v\n***\n", method, rr.Error, rr.Value))
 
 	if rr.IsErr() {
 		return nil, errors.New(rr.Error)
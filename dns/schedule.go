@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"math/rand"
+	"time"
+)
+
+/*
+**  POLL SCHEDULING:  HOW OFTEN THE CLIENT ASKS THE SERVER FOR DOWNSTREAM DATA
+**
+**  Polls go out every PollInterval while kcp has data in flight, and back off
+**  exponentially to PollMaxInterval when idle, give or take PollJitter.
+**  MaxQPS caps every query this module sends, polls or not.
+ */
+
+var (
+	defaultPollInterval    = 20 * time.Millisecond
+	defaultPollMaxInterval = 2 * time.Second
+)
+
+const (
+	defaultPollJitter = 0.2
+	defaultMaxQPS     = 50
+)
+
+// pollScheduler - the delay between polls for one client session
+type pollScheduler struct {
+	min, max time.Duration
+	jitter   float64
+	interval time.Duration
+}
+
+func (m *Module) newPollScheduler() *pollScheduler {
+	p := &pollScheduler{min: m.PollInterval, max: m.PollMaxInterval, jitter: m.PollJitter}
+	if p.max < p.min {
+		p.max = p.min
+	}
+	p.interval = p.min
+	return p
+}
+
+// next - the delay before the next poll, fast if busy, otherwise twice the last one up to the ceiling
+func (p *pollScheduler) next(busy bool) time.Duration {
+	if busy {
+		p.interval = p.min
+	} else if p.interval *= 2; p.interval > p.max || p.interval <= 0 {
+		p.interval = p.max
+	}
+	d := p.interval
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+	return d
+}
+
+// clientBusy - returns true if kcp has data queued or waiting to be acknowledged
+// An RPC waiting on its response doesn't count, a poll held by the server brings it as soon as it is ready
+func (m *Module) clientBusy(client *clientSession) bool {
+	client.mutex.Lock()
+	unacked := client.kcp.WaitSnd()
+	client.mutex.Unlock()
+
+	return unacked > 0 || len(client.upstreamKCPData) > 0
+}
+
+// throttle - waits until sending another query keeps under MaxQPS
+func (m *Module) throttle() {
+	if m.MaxQPS <= 0 {
+		return
+	}
+	m.throttleMutex.Lock()
+	defer m.throttleMutex.Unlock()
+
+	now := time.Now()
+	if m.nextQuery.After(now) {
+		time.Sleep(m.nextQuery.Sub(now))
+		now = m.nextQuery
+	}
+	m.nextQuery = now.Add(time.Duration(float64(time.Second) / m.MaxQPS))
+}
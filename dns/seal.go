@@ -0,0 +1,372 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/ratnet/api/events"
+	"golang.org/x/crypto/curve25519"
+)
+
+/*
+**  SEALING:  A HANDSHAKE AT SESSION START, THEN AUTHENTICATED ENCRYPTION OF EVERY KCP SEGMENT
+**
+**  The client sends an ephemeral X25519 key in a hello probe. The server answers with an ephemeral
+**  key of its own and a confirmation only the holder of its ECC SessionKey can make. The keys for
+**  each direction come from both shared secrets, so recorded sessions stay sealed if the SessionKey
+**  leaks later. Every kcp segment then travels as:
+**
+**     <sequence number><AES-GCM sealed segment>
+**
+**  Segments that fail to open, or open with a sequence number seen before, never reach kcp.
+**
+**  Without a ServerKey, a client trusts the first key each host sends and pins it, so a resolver
+**  on the path can only sit in the middle of a host's first session, not take over a later one.
+ */
+
+const (
+	// sealSeqLen - the sequence number in front of every sealed segment
+	sealSeqLen = 4
+
+	// sealOverhead - the bytes sealing adds to a segment, the sequence number and the GCM tag
+	sealOverhead = sealSeqLen + 16
+
+	// replayWindow - how far behind the newest sequence number a segment can arrive and still be accepted
+	replayWindow = 64
+
+	// helloAnswerLen - the server's ephemeral key and the confirmation
+	helloAnswerLen = curve25519.PointSize + 16
+)
+
+var (
+	// ErrHandshake - wrapped in the error RPC returns when a session can't be sealed, because the server doesn't seal
+	// or doesn't hold the key in ServerKey
+	ErrHandshake = errors.New("dns session handshake failed")
+
+	errUnsealed = errors.New("dns segment failed authentication")
+	errReplayed = errors.New("dns segment replayed")
+	errNoKeys   = errors.New("dns segment for a session without keys")
+)
+
+// labels for deriving session keys from the handshake secrets
+var (
+	sealUpLabel      = []byte("ratnet dns upstream")
+	sealDownLabel    = []byte("ratnet dns downstream")
+	sealConfirmLabel = []byte("ratnet dns confirm")
+)
+
+// sealer - the keys and sequence numbers for one end of a sealed session, guarded by the kcp mutex
+type sealer struct {
+	ad      []byte // the session ID, authenticated with every segment
+	out, in cipher.AEAD
+	seq     uint32 // last sequence number sealed
+	top     uint32 // newest sequence number opened
+	seen    uint64 // sequence numbers opened, bit i for top-i
+}
+
+func newSealer(id uint32, outKey, inKey []byte) (*sealer, error) {
+	s := &sealer{ad: make([]byte, 4)}
+	binary.BigEndian.PutUint32(s.ad, id)
+	var err error
+	if s.out, err = newAEAD(outKey); err != nil {
+		return nil, err
+	}
+	if s.in, err = newAEAD(inKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce - each direction has its own key, so the sequence number alone makes a unique nonce
+func nonce(seq uint32) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint32(n[8:], seq)
+	return n
+}
+
+// seal - returns a kcp packet sealed under the next sequence number
+func (s *sealer) seal(packet []byte) []byte {
+	s.seq++
+	b := make([]byte, sealSeqLen, sealOverhead+len(packet))
+	binary.BigEndian.PutUint32(b, s.seq)
+	return s.out.Seal(b, nonce(s.seq), packet, s.ad)
+}
+
+// open - returns the kcp packet in a sealed segment, or an error if it is forged or replayed
+func (s *sealer) open(b []byte) ([]byte, error) {
+	if len(b) < sealOverhead {
+		return nil, errUnsealed
+	}
+	seq := binary.BigEndian.Uint32(b)
+	if seq == 0 || s.replayed(seq) {
+		return nil, errReplayed
+	}
+	packet, err := s.in.Open(nil, nonce(seq), b[sealSeqLen:], s.ad)
+	if err != nil {
+		return nil, errUnsealed
+	}
+	s.mark(seq)
+	return packet, nil
+}
+
+// replayed - returns true if seq was opened before, or is too old to tell
+func (s *sealer) replayed(seq uint32) bool {
+	if seq > s.top {
+		return false
+	}
+	d := s.top - seq
+	return d >= replayWindow || s.seen&(1<<d) != 0
+}
+
+func (s *sealer) mark(seq uint32) {
+	if seq <= s.top {
+		s.seen |= 1 << (s.top - seq)
+		return
+	}
+	if d := seq - s.top; d < replayWindow {
+		s.seen <<= d
+	} else {
+		s.seen = 0
+	}
+	s.seen |= 1
+	s.top = seq
+}
+
+// sealSegment - seals a kcp packet, if this module seals
+// Before the session has keys it returns nil, the packet is dropped and kcp sends it again later
+func (m *Module) sealSegment(s *sealer, packet []byte) []byte {
+	if !m.Encrypt {
+		return packet
+	}
+	if s == nil {
+		return nil
+	}
+	return s.seal(packet)
+}
+
+// openSegment - returns the kcp packet in a segment, if this module seals, or an error if it should be dropped
+func (m *Module) openSegment(s *sealer, b []byte) ([]byte, error) {
+	if !m.Encrypt {
+		return b, nil
+	}
+	if s == nil {
+		return nil, errNoKeys
+	}
+	return s.open(b)
+}
+
+// sealOverhead - the bytes sealing adds to each kcp packet, if this module seals
+func (m *Module) sealOverhead() int {
+	if m.Encrypt {
+		return sealOverhead
+	}
+	return 0
+}
+
+// sessionKeys - derives the upstream and downstream keys and the server's confirmation from a handshake
+func sessionKeys(id uint32, staticSecret, ephemeralSecret, clientPub, serverPub []byte) (up, down, confirm []byte, err error) {
+	secret := append(append([]byte{}, staticSecret...), ephemeralSecret...)
+	salt := make([]byte, 4, 4+len(clientPub)+len(serverPub))
+	binary.BigEndian.PutUint32(salt, id)
+	salt = append(append(salt, clientPub...), serverPub...)
+
+	if up, err = bc.Kdf(secret, sealUpLabel, salt); err != nil {
+		return
+	}
+	if down, err = bc.Kdf(secret, sealDownLabel, salt); err != nil {
+		return
+	}
+	if confirm, err = bc.Kdf(secret, sealConfirmLabel, salt); err != nil {
+		return
+	}
+	return up, down, confirm[:16], nil
+}
+
+// newEphemeralKey - a random X25519 private key and its public key
+func newEphemeralKey() ([]byte, []byte, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	return priv, pub, err
+}
+
+//
+//  server side
+//
+
+// newSessionKey - a new ECC key pair for SessionKey
+func newSessionKey() bc.KeyPair {
+	kp := new(ecc.KeyPair)
+	kp.GenerateKey()
+	return kp
+}
+
+// handshakeKey - the server's X25519 private and public keys, from SessionKey, generated if it was set to nil
+func (m *Module) handshakeKey() ([]byte, []byte, error) {
+	m.keyMutex.Lock()
+	defer m.keyMutex.Unlock()
+	if m.SessionKey == nil {
+		m.SessionKey = newSessionKey()
+		events.Info(m.node, "dns generated a session key, public key: "+m.SessionKey.GetPubKey().ToB64())
+	}
+	if m.SessionKey.GetName() != ecc.NAME {
+		return nil, nil, errors.New("dns SessionKey is not an ECC key")
+	}
+	// bencrypt only gives up the private key in its serialized form, public then private
+	b, err := base64.StdEncoding.DecodeString(m.SessionKey.ToB64())
+	if err != nil || len(b) != 2*curve25519.ScalarSize {
+		return nil, nil, errors.New("dns SessionKey is malformed")
+	}
+	return b[curve25519.ScalarSize:], b[:curve25519.ScalarSize], nil
+}
+
+// answerHello - the server's half of the handshake, keys the session and returns its ephemeral key and confirmation
+// A session is only keyed once, a repeated hello gets the same answer and any other is refused
+func (m *Module) answerHello(id uint32, clientPub []byte) ([]byte, error) {
+	if !m.Encrypt || len(clientPub) != curve25519.PointSize {
+		return nil, errBadProbe
+	}
+	priv, _, err := m.handshakeKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s := m.getSession(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sealer != nil {
+		if bytes.Equal(s.hello, clientPub) {
+			return s.helloAnswer, nil
+		}
+		return nil, errors.New("dns session already keyed")
+	}
+
+	ephPriv, ephPub, err := newEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	staticSecret, err := curve25519.X25519(priv, clientPub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralSecret, err := curve25519.X25519(ephPriv, clientPub)
+	if err != nil {
+		return nil, err
+	}
+	up, down, confirm, err := sessionKeys(id, staticSecret, ephemeralSecret, clientPub, ephPub)
+	if err != nil {
+		return nil, err
+	}
+	if s.sealer, err = newSealer(id, down, up); err != nil {
+		return nil, err
+	}
+	s.hello = append([]byte{}, clientPub...)
+	s.helloAnswer = append(ephPub, confirm...)
+	return s.helloAnswer, nil
+}
+
+//
+//  client side
+//
+
+// handshake - keys a client session, after checking the server holds the key in ServerKey,
+// or whatever key it sends if ServerKey is empty
+func (m *Module) handshake(ctx context.Context, client *clientSession) error {
+	serverPub, err := m.serverKey(ctx, client)
+	if err != nil {
+		return err
+	}
+	ephPriv, ephPub, err := newEphemeralKey()
+	if err != nil {
+		return err
+	}
+	staticSecret, err := curve25519.X25519(ephPriv, serverPub)
+	if err != nil {
+		return fmt.Errorf("%w: bad server key", ErrHandshake)
+	}
+
+	hello := append([]byte{probeHello, 0, 0}, ephPub...)
+	answer, err := m.retryProbe(ctx, client, hello)
+	if err == errBadProbe || (err == nil && len(answer) != helloAnswerLen) {
+		return fmt.Errorf("%w: %s refused the hello, it may not seal", ErrHandshake, client.host)
+	} else if err != nil {
+		return err
+	}
+
+	ephemeralSecret, err := curve25519.X25519(ephPriv, answer[:curve25519.PointSize])
+	if err != nil {
+		return fmt.Errorf("%w: bad server answer", ErrHandshake)
+	}
+	up, down, confirm, err := sessionKeys(client.id, staticSecret, ephemeralSecret, ephPub, answer[:curve25519.PointSize])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(confirm, answer[curve25519.PointSize:]) {
+		return fmt.Errorf("%w: %s does not hold the server key", ErrHandshake, client.host)
+	}
+	s, err := newSealer(client.id, up, down)
+	if err != nil {
+		return err
+	}
+
+	client.mutex.Lock()
+	client.sealer = s
+	client.mutex.Unlock()
+	return nil
+}
+
+// serverKey - the server's public key, from ServerKey, or asked of the server and pinned to its host
+func (m *Module) serverKey(ctx context.Context, client *clientSession) ([]byte, error) {
+	if m.ServerKey != "" {
+		pub := new(ecc.PubKey)
+		if err := pub.FromB64(m.ServerKey); err != nil {
+			return nil, errors.New("dns ServerKey is malformed: " + err.Error())
+		}
+		return pub.ToBytes(), nil
+	}
+	answer, err := m.retryProbe(ctx, client, []byte{probeKey, 0, 0})
+	if err == errBadProbe || (err == nil && len(answer) != curve25519.PointSize) {
+		return nil, fmt.Errorf("%w: %s sent no key, it may not seal", ErrHandshake, client.host)
+	} else if err != nil {
+		return nil, err
+	}
+	return m.pinServerKey(client.host, answer)
+}
+
+// pinServerKey - the key host sent, if it is the first seen from host or the same one, ErrHandshake otherwise
+func (m *Module) pinServerKey(host string, key []byte) ([]byte, error) {
+	m.keyMutex.Lock()
+	defer m.keyMutex.Unlock()
+	if pinned, ok := m.serverKeys[host]; ok {
+		if !bytes.Equal(pinned, key) {
+			return nil, fmt.Errorf("%w: %s sent a key other than the one it first sent", ErrHandshake, host)
+		}
+		return pinned, nil
+	}
+	if m.serverKeys == nil {
+		m.serverKeys = make(map[string][]byte)
+	}
+	m.serverKeys[host] = key
+	events.Info(m.node, "dns client for "+host+" pinned server key "+base64.StdEncoding.EncodeToString(key))
+	return key, nil
+}
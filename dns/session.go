@@ -0,0 +1,287 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+/*
+**  SESSIONS:  ONE KCP STATE MACHINE PER CLIENT ON THE SERVER
+**
+**  Every query name ends with a header label just before the tunnel domain,
+**  which carries the query kind, the name codec of the data labels and the client's session ID:
+**
+**     <dotified KCP data>.<kind><codec><session ID>.<tunnel domain>
+**
+**  Polls carry a random nonce label instead of data, so caching resolvers always pass them on:
+**
+**     <nonce>.p<codec><session ID>.<tunnel domain>
+ */
+
+// query kinds, the first character of the header label
+const (
+	queryData  = 'd' // KCP data in the labels before the header
+	queryPoll  = 'p' // no data, just a nonce, collecting responses
+	queryProbe = 'n' // probe data outside of kcp, see probe.go
+)
+
+// headerLabelLen - a kind character and a codec ID followed by the base32 session ID
+const headerLabelLen = 9
+
+var sessionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ErrBadHeader - returned when a query name does not end in a valid header label
+var ErrBadHeader = errors.New("query name has no valid header label")
+
+// session - the server's state for one client
+type session struct {
+	id          uint32
+	kcp         *kcp.KCP
+	downstream  chan []byte
+	held        [][]byte // segments from a truncated response, sent first to the next query, guarded by mutex
+	mtu         int      // downstream kcp mtu, set by the client's probe, guarded by mutex
+	lastSeen    int64    // unix nanoseconds, atomic
+	counters    counters
+	resent      retransmitCounter // guarded by mutex
+	sealer      *sealer           // set once by the handshake, guarded by mutex
+	hello       []byte            // the client's handshake key, guarded by mutex
+	helloAnswer []byte            // the answer to it, for a hello a resolver sends again, guarded by mutex
+	fec         *fec              // set by the client's probe, guarded by mutex
+	compress    bool              // RPC frames carry a compression flag, set by the client's probe, guarded by mutex
+	rate        bucket            // for SessionQPS, guarded by mutex
+	waiting     []heldQuery       // queries held for downstream data, oldest first, guarded by mutex
+	conn        *streamConn       // the session as a stream, when the server was started by Listen, set when it opens, guarded by mutex
+	frames      reassembler       // RPC calls coming in, guarded by mutex
+
+	mutex    sync.Mutex // guards kcp, held, mtu and sealing
+	rpcMutex sync.Mutex // serializes RPC handling, so responses go out in order
+}
+
+// hold - keeps segments that didn't fit in a response, for the next query
+func (s *session) hold(segments [][]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.held = append(s.held, segments...)
+}
+
+// takeHeld - returns and forgets any segments held back from an earlier response
+func (s *session) takeHeld() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	held := s.held
+	s.held = nil
+	return held
+}
+
+// setMTU - sets the downstream mtu for this session, the largest segment in an answer
+// kcp gets what's left after overhead, what sealing adds to each of its packets, and FEC if it's on
+func (s *session) setMTU(n, overhead int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fec != nil {
+		overhead += fecOverhead
+	}
+	if s.kcp.SetMtu(n-overhead) == 0 {
+		s.mtu = n
+	}
+}
+
+// setFEC - turns on FEC for this session, returns false if kcp packets can't shrink to make room for it
+func (s *session) setFEC(f *fec, overhead int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.kcp.SetMtu(s.mtu-overhead-fecOverhead) != 0 {
+		return false
+	}
+	s.fec = f
+	return true
+}
+
+// msgSize - the largest message the session's kcp carries downstream, see msgSizeFor
+func (s *session) msgSize(overhead int) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fec != nil {
+		overhead += fecOverhead
+	}
+	return msgSizeFor(s.mtu, overhead)
+}
+
+// stream - the session as a stream, or nil if the server wasn't started by Listen or the session hasn't opened
+func (s *session) stream() *streamConn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn
+}
+
+// keyed - returns true if the handshake has given this session keys
+func (s *session) keyed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sealer != nil
+}
+
+// getMTU - returns the downstream mtu for this session
+func (s *session) getMTU() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.mtu
+}
+
+// newSessionID - makes a random session ID for a new client session
+func newSessionID() uint32 {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// pollNonce - a random label for a poll, so no two poll names are the same
+func pollNonce() string {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint32(b, uint32(time.Now().UnixNano()))
+	}
+	return strings.ToLower(sessionEncoding.EncodeToString(b))
+}
+
+// headerLabel - builds the header label for a query of the given kind
+func headerLabel(kind byte, codec NameCodec, id uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, id)
+	return string([]byte{kind, codec.ID()}) + strings.ToLower(sessionEncoding.EncodeToString(b))
+}
+
+// parseHeaderLabel - returns the query kind, name codec and session ID from a header label, ignoring case
+func parseHeaderLabel(label string) (byte, NameCodec, uint32, error) {
+	if len(label) != headerLabelLen {
+		return 0, nil, 0, ErrBadHeader
+	}
+	label = strings.ToLower(label)
+	kind := label[0]
+	if kind != queryData && kind != queryPoll && kind != queryProbe {
+		return 0, nil, 0, ErrBadHeader
+	}
+	codec, ok := nameCodecByID(label[1])
+	if !ok {
+		return 0, nil, 0, ErrBadHeader
+	}
+	b, err := sessionEncoding.DecodeString(strings.ToUpper(label[2:]))
+	if err != nil || len(b) != 4 {
+		return 0, nil, 0, ErrBadHeader
+	}
+	return kind, codec, binary.BigEndian.Uint32(b), nil
+}
+
+// querySuffix - everything that follows the data labels in a query name
+func querySuffix(kind byte, codec NameCodec, id uint32, zone string) string {
+	if zone == "" {
+		return headerLabel(kind, codec, id) + "."
+	}
+	return headerLabel(kind, codec, id) + "." + zone
+}
+
+// parseQueryName - splits a query name into its kind, session ID and data, decoded with the codec in its header
+func parseQueryName(name, zone string) (byte, uint32, []byte, error) {
+	if zone != "" {
+		if !mdns.IsSubDomain(zone, name) {
+			return 0, 0, nil, ErrOutOfZone
+		}
+		name = name[:len(name)-len(zone)]
+	}
+	labels := mdns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return 0, 0, nil, ErrBadHeader
+	}
+	kind, codec, id, err := parseHeaderLabel(labels[len(labels)-1])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if kind == queryPoll {
+		return kind, id, nil, nil // the labels before the header are just a nonce
+	}
+	data, err := UndotifyCodec(strings.Join(labels[:len(labels)-1], "."), "", codec)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return kind, id, data, nil
+}
+
+// getSession - returns the session with this ID, making a new one if needed
+func (m *Module) getSession(id uint32) *session {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		s = &session{id: id, downstream: make(chan []byte, channelSize), mtu: mtu}
+		s.kcp = kcp.NewKCP(m.ServerConv,
+			func(buf []byte, size int) {
+				if size > 0 {
+					b := make([]byte, size)
+					copy(b, buf[:size])
+					m.count(&s.counters, statRetransmits, s.resent.count(b))
+					for _, p := range m.wrapPacket(s.sealer, s.fec, b) {
+						s.queue(p)
+					}
+				}
+			})
+		s.kcp.SetMtu(mtu - m.sealOverhead()) // ((5/8) * 253) -8
+		// NoDelay options
+		// fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
+		// nodelay: 0:disable(default), 1:enable
+		// interval: internal update timer interval in millisec, default is 100ms
+		// resend: 0:disable fast resend(default), 1:enable fast resend
+		// nc: 0:normal congestion control(default), 1:disable congestion control
+		// s.kcp.NoDelay(1, 20, 2, 1)
+		s.kcp.NoDelay(0, 20, 0, 1)
+		m.sessions[id] = s
+	}
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+	return s
+}
+
+// liveSession - returns the session with this ID, or nil if there is none, or it hasn't finished its handshake
+func (m *Module) liveSession(id uint32) *session {
+	m.sessionsMutex.Lock()
+	s, ok := m.sessions[id]
+	m.sessionsMutex.Unlock()
+	if !ok || (m.Encrypt && !s.keyed()) {
+		return nil
+	}
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+	return s
+}
+
+// updateSessions - runs the KCP clock for every session, and forgets idle ones
+func (m *Module) updateSessions() {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	expired := time.Now().Add(-sessionTimeout).UnixNano()
+	for id, s := range m.sessions {
+		if atomic.LoadInt64(&s.lastSeen) < expired {
+			delete(m.sessions, id)
+			if conn := s.stream(); conn != nil {
+				conn.lose(ErrSessionExpired)
+			}
+			continue
+		}
+		s.mutex.Lock()
+		s.kcp.Update()
+		for _, p := range m.flushPackets(s.sealer, s.fec) {
+			s.queue(p)
+		}
+		s.mutex.Unlock()
+	}
+}
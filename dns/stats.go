@@ -0,0 +1,335 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+
+	"github.com/awgh/ratnet/api/events"
+)
+
+/*
+**  STATISTICS:  COUNTERS FOR THE MODULE, EACH CLIENT SESSION AND EACH SERVER SESSION
+**
+**  Every count goes to the module totals and to the session it happened in. Stats takes a
+**  snapshot, and in builds with the debug tag, where ratnet delivers events, the same snapshot
+**  goes out as an events.Info every StatsInterval.
+ */
+
+// defaultStatsInterval - how often stats are emitted as events, unless configured otherwise
+var defaultStatsInterval = time.Minute
+
+// Counters - running totals, for a session or for the whole module
+type Counters struct {
+	QueriesSent     uint64 // queries sent by client sessions, probes included
+	QueriesReceived uint64 // queries received by the server
+	Responses       uint64 // responses received by client sessions or sent by the server
+	Answers         uint64 // kcp segments packed into those responses
+	UpstreamBytes   uint64 // kcp bytes carried in query names
+	DownstreamBytes uint64 // kcp bytes carried in answers
+	DecodeFailures  uint64 // queries, answers and RPC frames that couldn't be decoded
+	Rejected        uint64 // sealed segments dropped as forged or replayed, and messages failing TSIG
+	EmptyPolls      uint64 // polls answered with no data
+	Retransmits     uint64 // kcp segments sent more than once
+	Recovered       uint64 // kcp segments rebuilt by FEC
+	Limited         uint64 // queries the server refused, dropped or didn't hold because of a limit
+	CompressIn      uint64 // RPC frame bytes sent in sessions that compress, before compression
+	CompressOut     uint64 // the same frames after compression, or as they went when it didn't help
+}
+
+// AnswersPerResponse - the average number of kcp segments packed into a response
+func (c Counters) AnswersPerResponse() float64 {
+	if c.Responses == 0 {
+		return 0
+	}
+	return float64(c.Answers) / float64(c.Responses)
+}
+
+// CompressionRatio - how many times smaller compression made the RPC frames sent, zero if none were
+func (c Counters) CompressionRatio() float64 {
+	if c.CompressOut == 0 {
+		return 0
+	}
+	return float64(c.CompressIn) / float64(c.CompressOut)
+}
+
+func (c Counters) String() string {
+	return fmt.Sprintf("queries sent/received %d/%d, responses %d, answers/response %.2f, bytes up/down %d/%d, decode failures %d, rejected %d, empty polls %d, retransmits %d, recovered %d, limited %d, compression %.2f",
+		c.QueriesSent, c.QueriesReceived, c.Responses, c.AnswersPerResponse(), c.UpstreamBytes, c.DownstreamBytes,
+		c.DecodeFailures, c.Rejected, c.EmptyPolls, c.Retransmits, c.Recovered, c.Limited, c.CompressionRatio())
+}
+
+// KCPStats - the state of one kcp connection, any kcp-go doesn't have in the version built with is -1
+type KCPStats struct {
+	MTU              int
+	RTT, RTTVar, RTO time.Duration // smoothed round trip time, its variation, and the retransmit timeout
+	SendWindow       int           // segments this end may have unacknowledged
+	RecvWindow       int           // segments this end can buffer
+	RemoteWindow     int           // segments the far end last said it could buffer
+	CongestionWindow int
+	WaitSnd          int // segments queued or not yet acknowledged
+}
+
+func (k KCPStats) String() string {
+	return fmt.Sprintf("mtu %d, rtt %v±%v, rto %v, windows snd/rcv/rmt/cwnd %d/%d/%d/%d, waitsnd %d",
+		k.MTU, k.RTT, k.RTTVar, k.RTO, k.SendWindow, k.RecvWindow, k.RemoteWindow, k.CongestionWindow, k.WaitSnd)
+}
+
+// SessionStats - the counters and kcp state of one session
+type SessionStats struct {
+	Counters
+	ID     uint32
+	Idle   time.Duration // since the last query, for server sessions
+	Window int           // pipelined queries the session may have in flight, for client sessions
+	KCP    KCPStats
+}
+
+// ResolverStats - the health of one resolver in the pool
+type ResolverStats struct {
+	Up       bool          // in the pool, not out after failing
+	Score    float64       // smoothed fraction of queries answered
+	RTT      time.Duration // smoothed time to an answer
+	Queries  uint64
+	Failures uint64
+}
+
+func (r ResolverStats) String() string {
+	state := "up"
+	if !r.Up {
+		state = "down"
+	}
+	return fmt.Sprintf("%s, score %.2f, rtt %v, queries %d, failures %d", state, r.Score, r.RTT.Round(time.Millisecond), r.Queries, r.Failures)
+}
+
+// Stats - a snapshot of the module totals and every live session
+type Stats struct {
+	Counters
+	Clients   map[string]SessionStats  // this node's client sessions, by upstream host
+	Sessions  map[uint32]SessionStats  // the server's sessions, by session ID
+	Resolvers map[string]ResolverStats // the resolver pool, by address
+}
+
+func (s Stats) String() string {
+	var b strings.Builder
+	b.WriteString("dns stats: " + s.Counters.String())
+	hosts := make([]string, 0, len(s.Clients))
+	for host := range s.Clients {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		c := s.Clients[host]
+		fmt.Fprintf(&b, "\n  client %s %08x window %d: %v; %v", host, c.ID, c.Window, c.Counters, c.KCP)
+	}
+	ids := make([]uint32, 0, len(s.Sessions))
+	for id := range s.Sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		c := s.Sessions[id]
+		fmt.Fprintf(&b, "\n  session %08x idle %v: %v; %v", id, c.Idle.Round(time.Millisecond), c.Counters, c.KCP)
+	}
+	addrs := make([]string, 0, len(s.Resolvers))
+	for addr := range s.Resolvers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "\n  resolver %s: %v", addr, s.Resolvers[addr])
+	}
+	return b.String()
+}
+
+// Stats - returns a snapshot of the module totals and every live session
+func (m *Module) Stats() Stats {
+	stats := Stats{
+		Counters:  m.counters.snapshot(),
+		Clients:   make(map[string]SessionStats),
+		Sessions:  make(map[uint32]SessionStats),
+		Resolvers: m.resolverStats(),
+	}
+
+	m.clientMutex.Lock()
+	clients := make([]*clientSession, 0, len(m.clientsByHost))
+	for _, client := range m.clientsByHost {
+		clients = append(clients, client)
+	}
+	m.clientMutex.Unlock()
+	for _, client := range clients {
+		client.mutex.Lock()
+		k := kcpStats(client.kcp)
+		client.mutex.Unlock()
+		stats.Clients[client.host] = SessionStats{Counters: client.counters.snapshot(), ID: client.id, Window: client.window.current(), KCP: k}
+	}
+
+	m.sessionsMutex.Lock()
+	sessions := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.sessionsMutex.Unlock()
+	now := time.Now().UnixNano()
+	for _, s := range sessions {
+		s.mutex.Lock()
+		k := kcpStats(s.kcp)
+		s.mutex.Unlock()
+		idle := time.Duration(now - atomic.LoadInt64(&s.lastSeen))
+		stats.Sessions[s.id] = SessionStats{Counters: s.counters.snapshot(), ID: s.id, Idle: idle, KCP: k}
+	}
+	return stats
+}
+
+// emitStats - sends the stats out as an event, if StatsInterval has passed since the last time
+// Called from the client and server clocks, the first call only starts the interval, and none build stats that would be dropped
+func (m *Module) emitStats() {
+	if m.StatsInterval <= 0 || !eventsOn {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&m.lastStats)
+	if last == 0 {
+		atomic.CompareAndSwapInt64(&m.lastStats, 0, now)
+		return
+	}
+	if now-last < int64(m.StatsInterval) || !atomic.CompareAndSwapInt64(&m.lastStats, last, now) {
+		return
+	}
+	events.Info(m.node, m.Stats().String())
+}
+
+//
+//  counters - the atomic version of Counters, kept by the module and by each session
+//
+
+type counter int
+
+const (
+	statQueriesSent counter = iota
+	statQueriesReceived
+	statResponses
+	statAnswers
+	statUpstreamBytes
+	statDownstreamBytes
+	statDecodeFailures
+	statRejected
+	statEmptyPolls
+	statRetransmits
+	statRecovered
+	statLimited
+	statCompressIn
+	statCompressOut
+	numStats
+)
+
+type counters [numStats]uint64
+
+// add - adds n to counter i, nil counters are ignored
+func (c *counters) add(i counter, n int) {
+	if c != nil && n > 0 {
+		atomic.AddUint64(&c[i], uint64(n))
+	}
+}
+
+func (c *counters) snapshot() Counters {
+	return Counters{
+		QueriesSent:     atomic.LoadUint64(&c[statQueriesSent]),
+		QueriesReceived: atomic.LoadUint64(&c[statQueriesReceived]),
+		Responses:       atomic.LoadUint64(&c[statResponses]),
+		Answers:         atomic.LoadUint64(&c[statAnswers]),
+		UpstreamBytes:   atomic.LoadUint64(&c[statUpstreamBytes]),
+		DownstreamBytes: atomic.LoadUint64(&c[statDownstreamBytes]),
+		DecodeFailures:  atomic.LoadUint64(&c[statDecodeFailures]),
+		Rejected:        atomic.LoadUint64(&c[statRejected]),
+		EmptyPolls:      atomic.LoadUint64(&c[statEmptyPolls]),
+		Retransmits:     atomic.LoadUint64(&c[statRetransmits]),
+		Recovered:       atomic.LoadUint64(&c[statRecovered]),
+		Limited:         atomic.LoadUint64(&c[statLimited]),
+		CompressIn:      atomic.LoadUint64(&c[statCompressIn]),
+		CompressOut:     atomic.LoadUint64(&c[statCompressOut]),
+	}
+}
+
+// count - adds n to counter i in the module totals, and in the session counters c if not nil
+func (m *Module) count(c *counters, i counter, n int) {
+	m.counters.add(i, n)
+	c.add(i, n)
+}
+
+// stats - the counters for this session, or nil if there is no session
+func (s *session) stats() *counters {
+	if s == nil {
+		return nil
+	}
+	return &s.counters
+}
+
+//
+//  kcp state - kcp-go keeps these unexported and has no getters for them, reflect can still read them
+//  The names are those of the kcp-go version pinned in go.mod, see the note there, and Test_Stats_1
+//  fails if an update renames one. A field another version lacks reads as -1, it never panics.
+//
+
+// kcpStats - reads the state of a kcp connection, which must be locked
+func kcpStats(k *kcp.KCP) KCPStats {
+	v := reflect.ValueOf(k).Elem()
+	field := func(name string) int {
+		switch f := v.FieldByName(name); f.Kind() {
+		case reflect.Int32:
+			return int(f.Int())
+		case reflect.Uint32:
+			return int(f.Uint())
+		}
+		return -1 // not there in this version of kcp-go
+	}
+	return KCPStats{
+		MTU:              field("mtu"),
+		RTT:              time.Duration(field("rx_srtt")) * time.Millisecond,
+		RTTVar:           time.Duration(field("rx_rttvar")) * time.Millisecond,
+		RTO:              time.Duration(field("rx_rto")) * time.Millisecond,
+		SendWindow:       field("snd_wnd"),
+		RecvWindow:       field("rcv_wnd"),
+		RemoteWindow:     field("rmt_wnd"),
+		CongestionWindow: field("cwnd"),
+		WaitSnd:          k.WaitSnd(),
+	}
+}
+
+// retransmitCounter - counts retransmitted data segments in kcp output, guarded by the kcp mutex
+// kcp-go only counts retransmits process-wide, so they're found by sequence number:
+// a data segment numbered below the next new one has been sent before
+type retransmitCounter struct {
+	next uint32
+	seen bool
+}
+
+// kcp segment header: conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4), little-endian
+const kcpCmdPush = 81
+
+// count - returns the number of retransmitted data segments in one kcp output packet
+func (r *retransmitCounter) count(buf []byte) int {
+	n := 0
+	for len(buf) >= kcp.IKCP_OVERHEAD {
+		cmd := buf[4]
+		sn := binary.LittleEndian.Uint32(buf[12:])
+		length := int(binary.LittleEndian.Uint32(buf[20:]))
+		if cmd == kcpCmdPush {
+			if r.seen && int32(sn-r.next) < 0 {
+				n++
+			} else {
+				r.next, r.seen = sn+1, true
+			}
+		}
+		if length < 0 || length > len(buf)-kcp.IKCP_OVERHEAD {
+			break
+		}
+		buf = buf[kcp.IKCP_OVERHEAD+length:]
+	}
+	return n
+}
@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+/*
+**  TSIG (RFC 8945):  HMAC-SHA256 SIGNATURES ON EVERY MESSAGE BETWEEN TUNNEL PEERS
+**
+**  With TSIGSecret set, clients sign every query, and the server answers unsigned or
+**  mis-signed queries with NOTAUTH and signs everything else. Clients drop any response
+**  that isn't signed with the same key. This only works where the peers talk directly,
+**  or through resolvers that pass the additional section on untouched.
+ */
+
+const (
+	// defaultTSIGKeyName - the name of the TSIG key, unless configured otherwise
+	defaultTSIGKeyName = "ratnet-dns."
+
+	// tsigFudge - seconds of clock skew allowed between the peers
+	tsigFudge = 300
+)
+
+// ErrTSIG - returned when a response is not signed with the TSIG key, or a query to a TSIG server isn't
+var ErrTSIG = errors.New("dns message failed TSIG authentication")
+
+// tsigEnabled - returns true if this module signs and verifies messages
+func (m *Module) tsigEnabled() bool {
+	return m.TSIGSecret != ""
+}
+
+// tsigKeyName - the canonical name of the TSIG key, as miekg/dns looks it up
+func (m *Module) tsigKeyName() string {
+	if m.TSIGKeyName == "" {
+		return defaultTSIGKeyName
+	}
+	return mdns.CanonicalName(m.TSIGKeyName)
+}
+
+// tsigSecrets - the secrets for an mdns.Client or mdns.Server, nil if this module doesn't sign
+func (m *Module) tsigSecrets() map[string]string {
+	if !m.tsigEnabled() {
+		return nil
+	}
+	return map[string]string{m.tsigKeyName(): m.TSIGSecret}
+}
+
+// newClient - an mdns.Client for net, with the TSIG secret if this module signs
+func (m *Module) newClient(net string) *mdns.Client {
+	return &mdns.Client{Net: net, ReadTimeout: clientTimeout, WriteTimeout: clientTimeout, TsigSecret: m.tsigSecrets()}
+}
+
+// signQuery - a copy of req with a TSIG record for the client to sign, or req itself if this module doesn't sign
+func (m *Module) signQuery(req *mdns.Msg) *mdns.Msg {
+	if !m.tsigEnabled() {
+		return req
+	}
+	q := req.Copy()
+	q.SetTsig(m.tsigKeyName(), mdns.HmacSHA256, tsigFudge, time.Now().Unix())
+	return q
+}
+
+// checkResponse - wraps a TSIG failure in ErrTSIG, and fails a response that should be signed and isn't
+// miekg/dns verifies signed responses, but lets unsigned ones through
+func (m *Module) checkResponse(r *mdns.Msg, err error) (*mdns.Msg, error) {
+	if !m.tsigEnabled() {
+		return r, err
+	}
+	switch err {
+	case nil:
+	case mdns.ErrSig, mdns.ErrTime, mdns.ErrSecret, mdns.ErrKeyAlg, mdns.ErrAuth:
+		return nil, fmt.Errorf("%w: %v", ErrTSIG, err)
+	default:
+		return r, err
+	}
+	if t := r.IsTsig(); t == nil || t.Hdr.Name != m.tsigKeyName() {
+		return nil, fmt.Errorf("%w: unsigned response", ErrTSIG)
+	}
+	return r, nil
+}
+
+// checkQuery - returns an error if this server verifies queries and req isn't signed with its key
+func (m *Module) checkQuery(w mdns.ResponseWriter, req *mdns.Msg) error {
+	if !m.tsigEnabled() {
+		return nil
+	}
+	t := req.IsTsig()
+	if t == nil {
+		return fmt.Errorf("%w: unsigned query", ErrTSIG)
+	}
+	if t.Hdr.Name != m.tsigKeyName() || mdns.CanonicalName(t.Algorithm) != mdns.HmacSHA256 {
+		return fmt.Errorf("%w: unknown key %s %s", ErrTSIG, t.Hdr.Name, t.Algorithm)
+	}
+	if err := w.TsigStatus(); err != nil {
+		return fmt.Errorf("%w: %v", ErrTSIG, err)
+	}
+	return nil
+}
+
+// tsigWriter - signs every response written through it, the server's ResponseWriter makes the MAC
+type tsigWriter struct {
+	mdns.ResponseWriter
+	name string
+}
+
+func (w *tsigWriter) WriteMsg(msg *mdns.Msg) error {
+	if msg.IsTsig() == nil {
+		msg.SetTsig(w.name, mdns.HmacSHA256, tsigFudge, time.Now().Unix())
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
@@ -1,9 +1,16 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	mdns "github.com/miekg/dns"
+	kcp "github.com/xtaci/kcp-go"
 
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/api/events"
@@ -13,77 +20,326 @@ import (
 **  UPSTREAM DIRECTION:  FROM THIS CLIENT OUTBOUND TO A REMOTE SERVER
  */
 
-// WriteUpstream - Writes KCP data in DNS Request form to the channel headed outbound from the client
-func (m *Module) WriteUpstream(buf []byte, size int) {
-	b := make([]byte, size)
-	copy(b, buf[:size])
-	m.upstreamKCPData <- b
+// clientSession - this node's client state for one upstream host
+type clientSession struct {
+	host            string
+	id              uint32
+	codec           NameCodec // spells query names, set once by probePath before the client loops start
+	maxMsgSize      int       // largest kcp message the path carries, RPC frames go in pieces this size, set by probePath
+	kcp             *kcp.KCP
+	upstreamKCPData chan []byte
+	wake            chan struct{}                      // cuts short the wait for the next poll when there is data to send
+	pending         map[uint32]chan api.RemoteResponse // RPCs waiting on a response, by request ID
+	calls           int                                // RPCs in flight, guarded by lifeMutex
+	timedOut        bool                               // an RPC timed out, so kcp state can't be trusted, guarded by lifeMutex
+	closed          bool                               // discarded, guarded by lifeMutex
+	done            chan struct{}                      // closed when the module is stopped
+	doneOnce        sync.Once
+	isRunning       uint32
+	wg              sync.WaitGroup
+	counters        counters
+	resent          retransmitCounter // guarded by mutex
+	sealer          *sealer           // set once by the handshake, guarded by mutex
+	probed          bool              // probePath has set up this session, guarded by lifeMutex
+	fec             *fec              // set by probePath if the server takes FEC, guarded by mutex
+	compress        bool              // RPC frames carry a compression flag, set once by probePath if the server agrees
+	conn            *streamConn       // the session as a stream, set by Dial before the client loops start
+	lost            chan struct{}     // closed when the server answers that it doesn't know the session
+	lostOnce        sync.Once
+	frames          reassembler         // RPC responses coming in, guarded by mutex
+	window          *flightWindow       // pipelined queries in flight
+	pipes           map[string]*udpPipe // UDP sockets for pipelined queries, by upstream address, guarded by pipeMutex
+
+	// mutexes
+	mutex        sync.Mutex // guards kcp
+	pendingMutex sync.Mutex // guards pending
+	lifeMutex    sync.Mutex // guards calls, starting and stopping
+	pipeMutex    sync.Mutex // guards pipes
 }
 
-// returns true if this should be called again
-func (m *Module) feedUpstream(sendEmpty bool) bool {
-	req := new(mdns.Msg)
+// IsRunning - returns true if this client is running
+func (c *clientSession) IsRunning() bool {
+	return atomic.LoadUint32(&c.isRunning) == 1
+}
+
+func (c *clientSession) setIsRunning(b bool) {
+	var running uint32 = 0
+	if b {
+		running = 1
+	}
+	atomic.StoreUint32(&c.isRunning, running)
+}
+
+// isLost - returns true if the server has forgotten this session
+func (c *clientSession) isLost() bool {
+	select {
+	case <-c.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// loseSession - gives up on a session the server has forgotten, after sessionTimeout or a restart
+// RPCs waiting on it fail with ErrSessionLost, and the next call starts a new session with fresh kcp state
+func (m *Module) loseSession(client *clientSession) {
+	client.lostOnce.Do(func() {
+		events.Warning(m.node, "dns session unknown to "+client.host+", starting over")
+		close(client.lost)
+		if client.conn != nil {
+			client.conn.lose(ErrSessionLost)
+		}
+	})
+}
+
+// signal - wakes the poll loop, without blocking
+func (c *clientSession) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// returns true if this should be called again, and true if any data went either way
+func (m *Module) feedUpstream(client *clientSession, sendEmpty bool) (bool, bool) {
 	var buf []byte
 	select {
-	case buf = <-m.upstreamKCPData:
+	case buf = <-client.upstreamKCPData:
+	default:
+		if !sendEmpty {
+			return false, false
+		}
+	}
+	req := m.upstreamQuery(client, buf)
+	if req == nil {
+		return false, false
+	}
+	r, err := m.exchange(client.host, req)
+	return m.takeResponse(client, buf, r, err)
+}
+
+// pollUpstream - sends a poll, leaving the kcp data to pumpUpstream
+// returns true if this should be called again, and true if any data came back
+func (m *Module) pollUpstream(client *clientSession) (bool, bool) {
+	r, err := m.exchange(client.host, m.upstreamQuery(client, nil))
+	return m.takeResponse(client, nil, r, err)
+}
+
+// upstreamQuery - a query carrying buf, or a poll if buf is nil, counted as sent
+// Returns nil if buf can't be spelled in a query name
+func (m *Module) upstreamQuery(client *clientSession, buf []byte) *mdns.Msg {
+	enc := m.recordEncoder()
+	req := new(mdns.Msg)
+	if buf != nil {
 		// base32 encode, then dotify / "DNS chop"
-		b32s, err := Dotify(buf)
+		b32s, err := DotifyCodec(buf, querySuffix(queryData, client.codec, client.id, m.zone()), client.codec)
 		if err != nil {
 			events.Error(m.node, err)
-			return false
+			return nil
 		}
-		req.SetQuestion(b32s, mdns.TypeCNAME)
-	default:
-		if !sendEmpty {
-			return false
-		}
-		req.SetQuestion("mail.", mdns.TypeMX) // send no data, just get response
+		req.SetQuestion(b32s, enc.Type())
+	} else {
+		req.SetQuestion(pollNonce()+"."+querySuffix(queryPoll, client.codec, client.id, m.zone()), enc.Type()) // send no data, just get response
 	}
 
 	req.RecursionDesired = true
 	// req.Compress = true
+	if m.EDNSSize > 0 {
+		req.SetEdns0(m.EDNSSize, false)
+	}
 
-	dnsClient := &mdns.Client{Net: "udp", ReadTimeout: clientTimeout, WriteTimeout: clientTimeout, SingleInflight: true}
-	r, _, err := dnsClient.Exchange(req, m.UpstreamStr)
+	m.count(&client.counters, statQueriesSent, 1)
+	m.count(&client.counters, statUpstreamBytes, len(buf))
+	return req
+}
+
+// takeResponse - feeds the answers to a query that carried buf into kcp
+// returns true if the client should go on, and true if any data went either way
+func (m *Module) takeResponse(client *clientSession, buf []byte, r *mdns.Msg, err error) (bool, bool) {
+	if err == nil && r.Rcode == mdns.RcodeNameError {
+		m.loseSession(client)
+		return false, false
+	}
 	if err == nil {
-		for _, value := range r.Answer {
-			bufd, errb := Undotify(value.Header().Name)
-			if errb != nil {
-				events.Warning(m.node, errb)
-				return false
-			}
+		segments, errb := m.recordEncoder().Decode(r.Answer)
+		if errb != nil {
+			m.count(&client.counters, statDecodeFailures, 1)
+			events.Warning(m.node, errb)
+			return false, buf != nil
+		}
+		m.count(&client.counters, statResponses, 1)
+		m.count(&client.counters, statAnswers, len(segments))
+		if buf == nil && len(segments) == 0 {
+			m.count(&client.counters, statEmptyPolls, 1)
+		}
+		ready := false
+		for _, bufd := range segments {
 			events.Info(m.node, "feedUpstream sending", string(bufd))
+			m.count(&client.counters, statDownstreamBytes, len(bufd))
 
-			m.clientMutex.Lock()
-			m.kcpClient.Input(bufd, true, false)
-			m.clientMutex.Unlock()
+			client.mutex.Lock()
+			packets, recovered, err := m.unwrapSegment(client.sealer, client.fec, bufd)
+			for _, packet := range packets {
+				client.kcp.Input(packet, true, false)
+			}
+			ready = ready || (len(packets) > 0 && client.kcp.PeekSize() > 0)
+			client.mutex.Unlock()
+			m.count(&client.counters, statRecovered, recovered)
+			if err != nil {
+				m.count(&client.counters, dropStat(err), 1)
+				events.Warning(m.node, "feedUpstream dropped segment: "+err.Error())
+			}
 		}
-	} else {
-		events.Warning(m.node, "DNS exchange failed in feedUpstream: ", m.UpstreamStr, err.Error())
+		if ready {
+			m.clientUpdate(client)
+		}
+		return true, buf != nil || len(segments) > 0
+	}
+	if errors.Is(err, ErrTSIG) {
+		m.count(&client.counters, statRejected, 1)
+	}
+	events.Warning(m.node, "DNS exchange failed in feedUpstream: ", client.host, err.Error())
+	return true, buf != nil
+}
+
+// exchange - sends a query for host's session and returns the response, through the resolver pool if Resolvers is set
+// Queries go over DoH to URLs and DoT to "tls://" addresses, and a truncated UDP response is retried over TCP
+func (m *Module) exchange(host string, req *mdns.Msg) (*mdns.Msg, error) {
+	return m.exchangePool(context.Background(), host, req, true)
+}
+
+// exchangeTCP - sends a query that got a truncated answer to addr again over TCP
+func (m *Module) exchangeTCP(addr string, req *mdns.Msg) (*mdns.Msg, error) {
+	// the answer didn't fit in a datagram, the server holds it for us to collect over TCP
+	events.Info(m.node, "feedUpstream response truncated, retrying over TCP")
+	m.throttle()
+	dnsClient := m.newClient("tcp")
+	dnsClient.SingleInflight = true
+	r, _, err := dnsClient.Exchange(m.signQuery(req), addr)
+	return m.checkResponse(r, err)
+}
+
+// exchangeOnce - like exchange, but returns a truncated response as it is, and gives up when ctx is done
+func (m *Module) exchangeOnce(ctx context.Context, host string, req *mdns.Msg) (*mdns.Msg, error) {
+	return m.exchangePool(ctx, host, req, false)
+}
+
+// exchangePool - sends a query to the resolver the pool picks, and once more to the next one if it goes unanswered
+// A truncated UDP response is retried over TCP if tcp is set
+func (m *Module) exchangePool(ctx context.Context, host string, req *mdns.Msg, tcp bool) (*mdns.Msg, error) {
+	addr := m.pickResolver(host)
+	r, err := m.exchangeVia(ctx, addr, req, tcp)
+	if answered(r, err) || errors.Is(err, ErrTSIG) || ctx.Err() != nil {
+		return r, err
+	}
+	if next := m.nextResolver(addr); next != "" {
+		events.Info(m.node, "dns query unanswered by "+addr+", sending it to "+next)
+		r, err = m.exchangeVia(ctx, next, req, tcp)
+	}
+	return r, err
+}
+
+// exchangeVia - sends a query to resolver addr, and reports how it did to the pool
+func (m *Module) exchangeVia(ctx context.Context, addr string, req *mdns.Msg, tcp bool) (*mdns.Msg, error) {
+	start := time.Now()
+	r, err := m.sendContext(ctx, addr, req)
+	if tcp && err == nil && r.Truncated && !isDoH(addr) && !isDoT(addr) {
+		r, err = m.exchangeTCP(addr, req)
 	}
+	m.reportResolver(addr, answered(r, err), time.Since(start))
+	return r, err
+}
 
-	m.debouncerClientUpdate.Trigger()
-	return true
+// send - sends a query to addr and returns the response, even if it is truncated
+// With TSIGSecret set, the query is signed and the response must be too
+func (m *Module) send(addr string, req *mdns.Msg) (*mdns.Msg, error) {
+	return m.sendContext(context.Background(), addr, req)
 }
 
-// pulls from kcpClient (user data received) and pushes to client responses channel
-func (m *Module) clientUpdate() {
-	buffer := make([]byte, maxMsgSize)
-	m.clientMutex.Lock()
-	n := m.kcpClient.Recv(buffer)
-	m.clientMutex.Unlock()
+// sendContext - like send, but waits no longer than ctx allows
+func (m *Module) sendContext(ctx context.Context, addr string, req *mdns.Msg) (*mdns.Msg, error) {
+	timeout := clientTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	} else if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	m.throttle()
+	req = m.signQuery(req)
+	if isDoH(addr) {
+		return m.checkResponse(m.exchangeDoH(ctx, addr, req))
+	}
+	if isDoT(addr) {
+		addr = strings.TrimPrefix(addr, dotScheme)
+		dnsClient := m.newClient("tcp-tls")
+		dnsClient.Timeout = timeout
+		dnsClient.TLSConfig = m.tlsClientConfig(addr)
+		r, _, err := dnsClient.Exchange(req, addr)
+		return m.checkResponse(r, err)
+	}
 
-	if n > 0 {
+	dnsClient := m.newClient("udp")
+	dnsClient.Timeout = timeout
+	dnsClient.SingleInflight = true
+	r, _, err := dnsClient.Exchange(req, addr)
+	return m.checkResponse(r, err)
+}
 
-		b := buffer[:n]
+// recordEncoder - the downstream encoder this node asks for in its client sessions
+func (m *Module) recordEncoder() RecordEncoder {
+	enc, err := RecordEncoderByName(m.RecordType)
+	if err != nil {
+		events.Warning(m.node, err.Error()+", using "+defaultRecordType)
+		return RecordEncoders[mdns.TypeTXT]
+	}
+	return enc
+}
+
+// pulls from a client's kcp (user data received) and hands responses to the RPCs waiting on them
+// A stream session is left for its reader instead
+func (m *Module) clientUpdate(client *clientSession) {
+	if client.conn != nil {
+		client.conn.signal()
+		return
+	}
+	client.mutex.Lock()
+	frames, err := client.frames.recv(client.kcp)
+	client.mutex.Unlock()
+	if err != nil {
+		m.count(&client.counters, statDecodeFailures, 1)
+		events.Warning(m.node, "dns rpc decode failed: "+err.Error())
+	}
+	for _, f := range frames {
+		id, b, err := unframe(f)
+		if err == nil && client.compress {
+			b, err = decompressPayload(b)
+		}
+		if err != nil {
+			m.count(&client.counters, statDecodeFailures, 1)
+			events.Warning(m.node, "dns rpc decode failed: "+err.Error())
+			continue
+		}
 		rr, err := api.RemoteResponseFromBytes(&b)
 		if err != nil {
+			m.count(&client.counters, statDecodeFailures, 1)
 			events.Warning(m.node, "dns rpc decode failed: "+err.Error())
-			return
+			continue
+		}
+
+		client.pendingMutex.Lock()
+		respchan, ok := client.pending[id]
+		delete(client.pending, id)
+		client.pendingMutex.Unlock()
+		if !ok {
+			events.Warning(m.node, fmt.Sprintf("dns rpc response for unknown request: %d", id))
+			continue
 		}
-		// blocking push
-		m.respchan <- *rr
+		respchan <- *rr // buffered, never blocks
 
-		events.Info(m.node, fmt.Sprintf("clientUpdate received response: %s, %+v\n", (*rr).Error, (*rr).Value))
+		events.Info(m.node, fmt.Sprintf("clientUpdate received response %d: %s, %+v\n", id, (*rr).Error, (*rr).Value))
 	}
 }
@@ -4,16 +4,17 @@ go 1.15
 
 require (
 	github.com/awgh/bencrypt v0.0.0-20190918184257-b65cb460b2c8
-	github.com/awgh/debouncer v1.0.0
+	github.com/awgh/debouncer v1.0.0 // indirect
 	github.com/awgh/ratnet v1.1.1-0.20210126100655-bea2d99c2477
 	github.com/aws/aws-sdk-go v1.36.28
-	github.com/klauspost/reedsolomon v1.9.11 // indirect
+	github.com/klauspost/reedsolomon v1.9.11
 	github.com/miekg/dns v1.1.35
 	github.com/pkg/profile v1.5.0
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
-	github.com/xtaci/kcp-go v5.4.20+incompatible
+	github.com/xtaci/kcp-go v5.4.20+incompatible // pinned, dns/stats.go reads kcp state from unexported fields of this version, check kcpStats before updating
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
 	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
 )